@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lelopez-io/media-privacy-service/internal/mediaprocessor"
+)
+
+// inspectResult pairs a file with its metadata report or the error that
+// prevented inspecting it.
+type inspectResult struct {
+	File   string                 `json:"file"`
+	Report *mediaprocessor.Report `json:"report,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// runInspect implements `cli inspect [path ...]`, printing a JSON report of
+// the metadata found in each file. Directories are inspected one level deep.
+func runInspect(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s inspect [flags] [path ...]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	indent := fs.Bool("indent", true, "Indent the JSON output")
+	fs.Parse(args)
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{filepath.Join("workdir", "cli", "input")}
+	}
+
+	files, err := collectFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	exitCode := 0
+	results := make([]inspectResult, 0, len(files))
+	for _, file := range files {
+		report, err := mediaprocessor.InspectFile(ctx, file)
+		result := inspectResult{File: file, Report: report}
+		if err != nil {
+			result.Error = err.Error()
+			exitCode = 1
+		}
+		results = append(results, result)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	if *indent {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(results); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+		return 1
+	}
+	return exitCode
+}
+
+// collectFiles expands paths into the files they name. Directories contribute
+// the supported files directly inside them.
+func collectFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error accessing %s: %v", path, err)
+		}
+		if !fileInfo.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading directory %s: %v", path, err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() && mediaprocessor.IsSupported(filepath.Join(path, entry.Name())) {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
@@ -1,15 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
 	"github.com/lelopez-io/media-privacy-service/internal/mediaprocessor"
 	"github.com/schollz/progressbar/v3"
@@ -21,13 +24,21 @@ var (
 	clean     *bool
 	imageOnly *bool
 	maxCPU    *bool
+	timeout   *time.Duration
+	policy    *string
+	orient    *string
+	pngToJPEG *bool
+	profile   *string
+	config    *string
+	antiPRNU  *float64
+	ffmpeg    *string
+	ffprobe   *string
 )
 
-var bar *progressbar.ProgressBar
-
 const (
-	colorRed   = "\033[0;31m"
-	colorReset = "\033[0m"
+	colorRed    = "\033[0;31m"
+	colorYellow = "\033[0;33m"
+	colorReset  = "\033[0m"
 )
 
 func init() {
@@ -36,13 +47,88 @@ func init() {
 	clean = flag.Bool("clean", false, "Clean the output directory before processing")
 	imageOnly = flag.Bool("image", false, "Process only image files")
 	maxCPU = flag.Bool("max", false, "Use maximum CPU cores for processing")
+	timeout = flag.Duration("timeout", 0, "Maximum time to spend on each file (0 for no limit)")
+	pngToJPEG = flag.Bool("png-to-jpeg", false, "Convert PNG files to JPEG instead of keeping them as PNG")
+	profile = flag.String("profile", "", "Transcoding profile for videos, e.g. passthrough, h264-small or audio-only (default: remove metadata in place without re-encoding)")
+	config = flag.String("config", "", "JSON config file with a default profile and custom profiles")
+	orient = flag.String("orientation", "bake", "How to handle rotated JPEGs and PNGs: bake (re-encode upright) or tag (lossless, keep orientation tag)")
+	policy = flag.String("policy", "strip-all", "Metadata to keep, e.g. allow:capture-date,copyright,icc-profile or deny:camera")
+	antiPRNU = flag.Float64("anti-fingerprint", 0, "Strength from 0 to 1 of the sensor noise (PRNU) mitigation applied to images (0 for off)")
+	ffmpeg = flag.String("ffmpeg", "", "Path to the ffmpeg program (default: found on PATH)")
+	ffprobe = flag.String("ffprobe", "", "Path to the ffprobe program (default: found on PATH)")
 }
 
 func main() {
+	// Cancel in-flight work, including FFmpeg, on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Subcommands take their own flags
+	if len(os.Args) > 1 {
+		subcommands := map[string]func(context.Context, []string) int{
+			"inspect": runInspect,
+			"verify":  runVerify,
+		}
+		if run, found := subcommands[os.Args[1]]; found {
+			code := run(ctx, os.Args[2:])
+			stop()
+			os.Exit(code)
+		}
+	}
+
 	flag.Parse()
 
+	retention, err := mediaprocessor.ParsePolicy(*policy)
+	if err != nil {
+		log.Fatalf("Invalid --policy: %v", err)
+	}
+	orientation, err := mediaprocessor.ParseOrientationMode(*orient)
+	if err != nil {
+		log.Fatalf("Invalid --orientation: %v", err)
+	}
+	profileName := *profile
+	var limits mediaprocessor.Limits
+	if *config != "" {
+		cfg, err := mediaprocessor.LoadConfig(*config)
+		if err != nil {
+			log.Fatalf("Invalid --config: %v", err)
+		}
+		if profileName == "" {
+			profileName = cfg.Profile
+		}
+		if cfg.Limits != nil {
+			limits = *cfg.Limits
+		}
+	}
+	transcode, err := mediaprocessor.ParseProfile(profileName)
+	if err != nil {
+		log.Fatalf("Invalid --profile: %v", err)
+	}
+	if *antiPRNU < 0 || *antiPRNU > 1 {
+		log.Fatalf("Invalid --anti-fingerprint: %g is not between 0 and 1", *antiPRNU)
+	}
+
+	// Videos need FFmpeg for any profile, and are verified with FFprobe when
+	// it is there
+	mediaprocessor.DefaultTranscoder = &mediaprocessor.FFmpeg{Path: *ffmpeg, ProbePath: *ffprobe}
+	if !*imageOnly {
+		caps, err := mediaprocessor.DefaultTranscoder.Capabilities(ctx)
+		switch {
+		case err != nil && transcode != nil:
+			log.Fatalf("Cannot transcode with --profile: %v", err)
+		case err != nil:
+			fmt.Printf("%sWarning: %v; videos can only be scrubbed without a profile%s\n", colorYellow, err, colorReset)
+		case transcode != nil:
+			if err := caps.CheckProfile(*transcode); err != nil {
+				log.Fatalf("Invalid --profile: %v", err)
+			}
+		}
+	}
+
+	opts := mediaprocessor.Options{Timeout: *timeout, Policy: retention, Orientation: orientation, ConvertPNG: *pngToJPEG, Profile: transcode, AntiFingerprint: *antiPRNU, Limits: limits}
+
 	// Create default directories if they don't exist
-	err := os.MkdirAll(*inputDir, os.ModePerm)
+	err = os.MkdirAll(*inputDir, os.ModePerm)
 	if err != nil {
 		log.Fatalf("Failed to create input directory: %v", err)
 	}
@@ -80,54 +166,50 @@ func main() {
 		log.Fatalf("Error accessing input: %v", err)
 	}
 
+	// A single file is processed as a batch of one
+	var files []string
 	if fileInfo.IsDir() {
-		// Process all files in the directory concurrently
-		files, err := ioutil.ReadDir(*inputDir)
+		entries, err := os.ReadDir(*inputDir)
 		if err != nil {
 			log.Fatalf("Error reading input directory: %v", err)
 		}
-
-		processFilesConcurrently(files, *inputDir, *outputDir)
+		for _, entry := range entries {
+			if entry.IsDir() || entry.Name() == ".DS_Store" {
+				continue // Skip directories and .DS_Store files
+			}
+			files = append(files, filepath.Join(*inputDir, entry.Name()))
+		}
 	} else {
-		// Process single file
-		bar = progressbar.NewOptions(1,
-			progressbar.OptionEnableColorCodes(true),
-			progressbar.OptionShowCount(),
-			progressbar.OptionSetWidth(15),
-			progressbar.OptionSetDescription("[cyan][1/1][reset] Processing file..."),
-			progressbar.OptionSetTheme(progressbar.Theme{
-				Saucer:        "[green]=[reset]",
-				SaucerHead:    "[green]>[reset]",
-				SaucerPadding: " ",
-				BarStart:      "[",
-				BarEnd:        "]",
-			}))
-		processFile(*inputDir, *outputDir)
-		bar.Finish()
+		files = []string{*inputDir}
 	}
 
-	fmt.Println("Processing complete.")
+	summary := processFiles(ctx, files, *outputDir, opts)
+	fmt.Printf("Processing complete: %d processed, %d failed in %s.\n", summary.Succeeded, summary.Failed, summary.Elapsed.Round(time.Millisecond))
 }
 
-func processFilesConcurrently(files []os.FileInfo, inputDir, outputDir string) {
-	numCPU := runtime.NumCPU()
-	numWorkers := numCPU / 2
-	if *maxCPU {
-		numWorkers = numCPU
-	}
-	sem := make(chan struct{}, numWorkers)
-	var wg sync.WaitGroup
+// processFiles scrubs files into outputDir, naming each output after its
+// position in files and the format found in it.
+func processFiles(ctx context.Context, files []string, outputDir string, opts mediaprocessor.Options) mediaprocessor.BatchSummary {
+	var items []mediaprocessor.BatchItem
+	for _, inputPath := range files {
+		// Check if we should process only images and if the current file is an image
+		if *imageOnly && !isImageFile(inputPath) {
+			printColoredMessageLn(colorRed, fmt.Sprintf("Skipping non-image file: %s", inputPath))
+			continue
+		}
 
-	// Filter out .DS_Store files and count valid files
-	validFiles := 0
-	for _, file := range files {
-		if file.Name() != ".DS_Store" && !file.IsDir() {
-			validFiles++
+		// Name the output after the format found in the file, which may
+		// not be the one its extension claims
+		ext, _, err := mediaprocessor.ResolveFileExt(inputPath)
+		if err != nil {
+			ext = filepath.Ext(inputPath)
 		}
+		outputFilename := mediaprocessor.GenerateOrderedFilename(len(items)+1, ext, opts)
+		items = append(items, mediaprocessor.BatchItem{InputPath: inputPath, OutputPath: filepath.Join(outputDir, outputFilename)})
 	}
 
 	// Initialize progress bar
-	bar = progressbar.NewOptions(validFiles*2, // Multiply by 2 for preparation and processing steps
+	bar := progressbar.NewOptions(len(items)*100, // Each file counts for 100 percent
 		progressbar.OptionEnableColorCodes(true),
 		progressbar.OptionShowCount(),
 		progressbar.OptionSetWidth(15),
@@ -140,60 +222,50 @@ func processFilesConcurrently(files []os.FileInfo, inputDir, outputDir string) {
 			BarEnd:        "]",
 		}))
 
-	fileCounter := 0
-	for _, file := range files {
-		if file.IsDir() || file.Name() == ".DS_Store" {
-			continue // Skip directories and .DS_Store files
+	// Move the bar as each file makes progress, then account for whatever
+	// is left once it is done or has failed
+	reported := make([]int, len(items))
+	advance := func(index, percent int) {
+		if step := percent - reported[index]; step > 0 {
+			bar.Add(step)
+			reported[index] += step
 		}
-
-		fileCounter++
-		wg.Add(1)
-		sem <- struct{}{} // Acquire semaphore
-
-		inputPath := filepath.Join(inputDir, file.Name())
-		outputFilename := mediaprocessor.GenerateOrderedFilename(fileCounter, filepath.Ext(file.Name()))
-		outputPath := filepath.Join(outputDir, outputFilename)
-
-		go func(inputPath, outputPath string) {
-			defer wg.Done()
-			defer func() { <-sem }() // Release semaphore
-
-			err := processFile(inputPath, outputPath)
-			if err != nil {
-				printColoredMessageLn(colorRed, fmt.Sprintf("Error processing file %s: %v", inputPath, err))
-			}
-		}(inputPath, outputPath)
 	}
 
-	wg.Wait()
-	bar.Finish()
-}
-
-func processFile(inputPath, outputPath string) error {
-	if !mediaprocessor.IsSupported(inputPath) {
-		printColoredMessageLn(colorRed, fmt.Sprintf("Skipping unsupported file: %s", inputPath))
-		bar.Add(2) // Add 2 steps for unsupported files
-		return nil
+	concurrency := 0 // Half the CPUs
+	if *maxCPU {
+		concurrency = runtime.NumCPU()
 	}
-
-	// Check if we should process only images and if the current file is an image
-	if *imageOnly && !isImageFile(inputPath) {
-		printColoredMessageLn(colorRed, fmt.Sprintf("Skipping non-image file: %s", inputPath))
-		bar.Add(2) // Add 2 steps for skipped files
-		return nil
+	batch := mediaprocessor.Batch{
+		Concurrency: concurrency,
+		Options:     opts,
+		OnEvent: func(event mediaprocessor.BatchEvent) {
+			inputPath := event.Item.InputPath
+			switch event.Type {
+			case mediaprocessor.EventStarted:
+				if event.Mismatch != nil {
+					printColoredMessageLn(colorYellow, fmt.Sprintf("Warning: %s: %s, processing it as such", inputPath, event.Mismatch))
+				}
+			case mediaprocessor.EventProgress:
+				advance(event.Index, int(event.Percent))
+			case mediaprocessor.EventDone:
+				for _, track := range event.Dropped {
+					fmt.Printf("Dropped %s track %d (%s) from %s\n", track.Type, track.Index, track.Codec, inputPath)
+				}
+				advance(event.Index, 100)
+			case mediaprocessor.EventFailed:
+				if errors.Is(event.Err, mediaprocessor.ErrUnsupportedFormat) {
+					printColoredMessageLn(colorRed, fmt.Sprintf("Skipping unsupported file %s: %v", inputPath, event.Err))
+				} else {
+					printColoredMessageLn(colorRed, fmt.Sprintf("Error processing file %s: %v", inputPath, event.Err))
+				}
+				advance(event.Index, 100)
+			}
+		},
 	}
-
-	// Reading file step
-	bar.Describe(fmt.Sprintf("Processing files..."))
-	bar.Add(1)
-
-	err := mediaprocessor.ProcessLocalMediaFile(inputPath, outputPath)
-
-	// Saving output step
-	bar.Describe(fmt.Sprintf("Processing files..."))
-	bar.Add(1)
-
-	return err
+	summary := batch.Run(ctx, items)
+	bar.Finish()
+	return summary
 }
 
 func cleanOutputDir(dir string) error {
@@ -222,8 +294,14 @@ func printColoredMessageLn(color, message string) {
 	fmt.Println(color + message + colorReset)
 }
 
+// isImageFile reports whether the file holds an image, judging by its
+// content when it can be read and by its extension otherwise.
 func isImageFile(filePath string) bool {
-	ext := strings.ToLower(filepath.Ext(filePath))
+	ext, _, err := mediaprocessor.ResolveFileExt(filePath)
+	if err != nil {
+		ext = filepath.Ext(filePath)
+	}
+	ext = strings.ToLower(ext)
 	imageExtensions := map[string]bool{
 		".jpg":  true,
 		".jpeg": true,
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/lelopez-io/media-privacy-service/internal/mediaprocessor"
+)
+
+// verifyResult pairs a file with the metadata left in it or the error that
+// prevented checking it.
+type verifyResult struct {
+	File     string                   `json:"file"`
+	Clean    bool                     `json:"clean"`
+	Findings []mediaprocessor.Finding `json:"findings,omitempty"`
+	Error    string                   `json:"error,omitempty"`
+}
+
+// runVerify implements `cli verify [path ...]`, auditing scrubbed files for
+// metadata the policy does not keep. It prints a JSON report and returns 1
+// if any file is not clean or could not be checked.
+func runVerify(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s verify [flags] [path ...]\n", filepath.Base(os.Args[0]))
+		fs.PrintDefaults()
+	}
+	indent := fs.Bool("indent", true, "Indent the JSON output")
+	policyFlag := fs.String("policy", "strip-all", "Metadata the files are allowed to keep, as given to --policy when scrubbing")
+	fs.Parse(args)
+
+	retention, err := mediaprocessor.ParsePolicy(*policyFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --policy: %v\n", err)
+		return 1
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{filepath.Join("workdir", "cli", "output")}
+	}
+
+	files, err := collectFiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	exitCode := 0
+	results := make([]verifyResult, 0, len(files))
+	for _, file := range files {
+		findings, err := mediaprocessor.VerifyFile(ctx, file, retention)
+		result := verifyResult{File: file, Clean: err == nil && len(findings) == 0, Findings: findings}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		if !result.Clean {
+			exitCode = 1
+		}
+		results = append(results, result)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	if *indent {
+		encoder.SetIndent("", "  ")
+	}
+	if err := encoder.Encode(results); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+		return 1
+	}
+	return exitCode
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lelopez-io/media-privacy-service/internal/mediaprocessor"
+)
+
+// jobStatus is how far a job has got.
+type jobStatus string
+
+const (
+	jobQueued  jobStatus = "queued"
+	jobRunning jobStatus = "running"
+	jobDone    jobStatus = "done"
+	jobFailed  jobStatus = "failed"
+)
+
+var errQueueFull = errors.New("too many jobs waiting to be processed")
+
+// job scrubs an upload in the background. Its input and output are files
+// of its own scratch job: the input is wiped once the job finishes, the
+// output once the job is deleted or expires and no download still reads it.
+type job struct {
+	id       string
+	name     string // of the upload
+	filename string // of the output
+	ext      string
+	opts     mediaprocessor.Options
+	input    *os.File
+	output   *os.File
+	scratch  *mediaprocessor.ScratchJob
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// Guarded by jobStore.mutex
+	status   jobStatus
+	progress float64
+	mismatch string
+	dropped  []mediaprocessor.DroppedTrack
+	err      error
+	finished time.Time
+	users    int // the worker running the job and downloads of its result
+	removed  bool
+}
+
+// jobStore holds the jobs of the server and feeds them to a fixed number of
+// workers through a bounded queue. Finished jobs are kept for ttl, then
+// deleted along with their results.
+type jobStore struct {
+	mutex sync.Mutex
+	jobs  map[string]*job
+	queue chan *job
+	ttl   time.Duration
+}
+
+// jobResponse is the JSON body describing a job.
+type jobResponse struct {
+	ID       string  `json:"id"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	Filename string  `json:"filename"`
+	// FormatMismatch is set when the upload's extension did not match its
+	// content, as in the X-Format-Mismatch header
+	FormatMismatch string `json:"format_mismatch,omitempty"`
+	// DroppedTracks lists the removed tracks as X-Dropped-Track does
+	DroppedTracks []string       `json:"dropped_tracks,omitempty"`
+	Error         *errorResponse `json:"error,omitempty"`
+}
+
+func newJobStore(workers, queueSize int, ttl time.Duration) *jobStore {
+	s := &jobStore{jobs: make(map[string]*job), queue: make(chan *job, queueSize), ttl: ttl}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	go s.expireJobs()
+	return s
+}
+
+// submit queues j, or fails with errQueueFull when the queue has no room.
+func (s *jobStore) submit(j *job) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	select {
+	case s.queue <- j:
+		s.jobs[j.id] = j
+		return nil
+	default:
+		return errQueueFull
+	}
+}
+
+func (s *jobStore) work() {
+	for j := range s.queue {
+		s.mutex.Lock()
+		if j.removed {
+			// Deleted while queued, and wiped already
+			s.mutex.Unlock()
+			continue
+		}
+		j.status = jobRunning
+		j.users++
+		s.mutex.Unlock()
+
+		err := j.run()
+		j.scratch.Remove(j.input)
+		if err != nil {
+			j.scratch.Remove(j.output)
+		}
+
+		s.mutex.Lock()
+		j.finished = time.Now()
+		j.err = err
+		if err != nil {
+			j.status = jobFailed
+		} else {
+			j.status = jobDone
+			j.progress = 100
+		}
+		removed := j.removed
+		s.mutex.Unlock()
+
+		if err != nil && !removed {
+			log.Printf("Job %s failed to process %s: %v\n", j.id, j.name, err)
+		}
+		s.release(j)
+	}
+}
+
+// run processes the job, turning a panic into an error so that the worker
+// carries on.
+func (j *job) run() (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Job %s panicked: %v\n%s", j.id, p, debug.Stack())
+			err = fmt.Errorf("error processing file: panic: %v", p)
+		}
+	}()
+	return mediaprocessor.Process(j.ctx, j.input, j.output, j.ext, j.opts)
+}
+
+// lookup returns the job with the given ID, or nil if there is none.
+func (s *jobStore) lookup(id string) *job {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.jobs[id]
+}
+
+// acquire returns the job with the given ID, or nil if there is none, with
+// its status and error. A done job is kept from being wiped until release.
+func (s *jobStore) acquire(id string) (*job, jobStatus, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	j, found := s.jobs[id]
+	if !found {
+		return nil, "", nil
+	}
+	if j.status == jobDone {
+		j.users++
+	}
+	return j, j.status, j.err
+}
+
+// release undoes acquire, wiping the job if it was removed meanwhile.
+func (s *jobStore) release(j *job) {
+	s.mutex.Lock()
+	j.users--
+	wipe := j.removed && j.users == 0
+	s.mutex.Unlock()
+	if wipe {
+		j.scratch.Close()
+	}
+}
+
+// remove deletes the job with the given ID, cancelling it if it has not
+// finished, and reports whether there was one. Its files are wiped as soon
+// as nothing uses them.
+func (s *jobStore) remove(id string) bool {
+	s.mutex.Lock()
+	j, found := s.jobs[id]
+	if found {
+		delete(s.jobs, id)
+		j.removed = true
+		j.cancel()
+	}
+	wipe := found && j.users == 0
+	s.mutex.Unlock()
+	if wipe {
+		j.scratch.Close()
+	}
+	return found
+}
+
+func (s *jobStore) expireJobs() {
+	for {
+		time.Sleep(min(max(s.ttl/4, time.Second), time.Hour))
+		s.expire(time.Now())
+	}
+}
+
+// expire removes the jobs that finished more than ttl ago.
+func (s *jobStore) expire(now time.Time) {
+	var expired []string
+	s.mutex.Lock()
+	for id, j := range s.jobs {
+		if !j.finished.IsZero() && now.Sub(j.finished) > s.ttl {
+			expired = append(expired, id)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, id := range expired {
+		s.remove(id)
+	}
+	if len(expired) > 0 {
+		log.Printf("Expired %d jobs\n", len(expired))
+	}
+}
+
+// view returns the JSON body describing j.
+func (s *jobStore) view(j *job) jobResponse {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body := jobResponse{ID: j.id, Status: string(j.status), Progress: j.progress, Filename: j.filename, FormatMismatch: j.mismatch}
+	for _, track := range j.dropped {
+		body.DroppedTracks = append(body.DroppedTracks, droppedTrackHeader(track))
+	}
+	if j.err != nil {
+		errBody := newErrorResponse(mediaprocessor.ErrorCode(j.err), j.err)
+		body.Error = &errBody
+	}
+	return body
+}
+
+// newJobID returns a random job ID, which only the client that submitted
+// the job learns.
+func newJobID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating job ID: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// handleCreateJob queues the upload for scrubbing and answers at once with
+// 202 Accepted and the job's ID. It takes the same form as /scrub-metadata.
+func handleCreateJob(w http.ResponseWriter, r *http.Request) {
+	scratch := mediaprocessor.DefaultScratch.NewJob()
+	defer scratch.Close()
+
+	file, header, err := formFile(w, r, scratch)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	defer file.Close()
+
+	opts, err := scrubOptions(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+
+	ext, err := resolveExt(w, file, header)
+	if err != nil {
+		processingError(w, err)
+		return
+	}
+
+	// Files that cannot be processed are refused now rather than queued
+	if _, supported := mediaprocessor.DefaultRegistry.Lookup(ext); !supported {
+		processingError(w, fmt.Errorf("%w: %s", mediaprocessor.ErrUnsupportedFormat, ext))
+		return
+	}
+
+	j, err := newJob(file, header.Filename, ext, opts)
+	if err != nil {
+		processingError(w, err)
+		return
+	}
+	j.mismatch = w.Header().Get("X-Format-Mismatch")
+
+	err = jobs.submit(j)
+	if err != nil {
+		j.cancel()
+		j.scratch.Close()
+		w.Header().Set("Retry-After", "30")
+		writeError(w, http.StatusServiceUnavailable, "queue_full", err)
+		return
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.id)
+	writeJSON(w, http.StatusAccepted, jobs.view(j))
+}
+
+// newJob copies the upload in file into the scratch files of a new job.
+func newJob(file io.Reader, name, ext string, opts mediaprocessor.Options) (*job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+
+	order := int(atomic.AddUint64(&fileCounter, 1))
+	j := &job{id: id, name: name, ext: ext, status: jobQueued, scratch: mediaprocessor.DefaultScratch.NewJob()}
+	j.filename = mediaprocessor.GenerateOrderedFilename(order, ext, opts)
+
+	j.input, err = j.scratch.CreateTemp("upload-*" + ext)
+	if err == nil {
+		_, err = io.Copy(j.input, file)
+	}
+	if err == nil {
+		_, err = j.input.Seek(0, io.SeekStart)
+	}
+	if err == nil {
+		j.output, err = j.scratch.CreateTemp("scrub-result-*" + filepath.Ext(j.filename))
+	}
+	if err != nil {
+		j.scratch.Close()
+		return nil, fmt.Errorf("error storing upload: %w", err)
+	}
+
+	opts.Scratch = j.scratch
+	opts.Progress = func(percent float64) {
+		jobs.mutex.Lock()
+		defer jobs.mutex.Unlock()
+		j.progress = percent
+	}
+	opts.TrackDropped = func(track mediaprocessor.DroppedTrack) {
+		log.Printf("Dropped %s track %d (%s) from %s", track.Type, track.Index, track.Codec, name)
+		jobs.mutex.Lock()
+		defer jobs.mutex.Unlock()
+		j.dropped = append(j.dropped, track)
+	}
+	j.opts = opts
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	return j, nil
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	j := jobs.lookup(r.PathValue("id"))
+	if j == nil {
+		writeError(w, http.StatusNotFound, "not_found", errors.New("job not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, jobs.view(j))
+}
+
+// handleJobResult sends the scrubbed file of a done job, the error of a
+// failed one, and 409 Conflict while the job is still queued or running.
+func handleJobResult(w http.ResponseWriter, r *http.Request) {
+	j, status, err := jobs.acquire(r.PathValue("id"))
+	switch {
+	case j == nil:
+		writeError(w, http.StatusNotFound, "not_found", errors.New("job not found"))
+		return
+	case status == jobFailed:
+		processingError(w, err)
+		return
+	case status != jobDone:
+		writeError(w, http.StatusConflict, "not_ready", fmt.Errorf("job is %s", status))
+		return
+	}
+	defer jobs.release(j)
+
+	info, err := j.output.Stat()
+	if err != nil {
+		processingError(w, fmt.Errorf("error reading result: %w", err))
+		return
+	}
+
+	body := jobs.view(j)
+	if body.FormatMismatch != "" {
+		w.Header().Set("X-Format-Mismatch", body.FormatMismatch)
+	}
+	for _, track := range body.DroppedTracks {
+		w.Header().Add("X-Dropped-Track", track)
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", j.filename))
+
+	// Downloads may overlap, so each reads the result at its own offsets
+	http.ServeContent(w, r, j.filename, info.ModTime(), io.NewSectionReader(j.output, 0, info.Size()))
+}
+
+func handleDeleteJob(w http.ResponseWriter, r *http.Request) {
+	if !jobs.remove(r.PathValue("id")) {
+		writeError(w, http.StatusNotFound, "not_found", errors.New("job not found"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeJSON sends body as a JSON response.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
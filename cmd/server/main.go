@@ -1,89 +1,370 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/lelopez-io/media-privacy-service/internal/mediaprocessor"
 )
 
 var (
 	port        *int
+	timeout     *time.Duration
+	config      *string
+	ffmpeg      *string
+	ffprobe     *string
+	inMemory    *bool
+	scratchDir  *string
+	jobWorkers  *int
+	jobQueue    *int
+	jobTTL      *time.Duration
 	fileCounter uint64
+
+	// jobs holds the uploads scrubbed in the background
+	jobs *jobStore
+
+	// defaultProfile is used for uploads that do not name a profile
+	defaultProfile string
+	// limits guards against uploads too large to process safely
+	limits = mediaprocessor.DefaultLimits
 )
 
+// formOverhead is the room left in request bodies for the multipart
+// encoding and the other form fields around an upload.
+const formOverhead = 1 << 20
+
 func init() {
 	port = flag.Int("port", 8080, "Port to run the server on")
+	timeout = flag.Duration("timeout", 10*time.Minute, "Maximum time to spend processing a single upload")
+	config = flag.String("config", "", "JSON config file with a default profile and custom profiles")
+	ffmpeg = flag.String("ffmpeg", "", "Path to the ffmpeg program (default: found on PATH)")
+	ffprobe = flag.String("ffprobe", "", "Path to the ffprobe program (default: found on PATH)")
+	inMemory = flag.Bool("in-memory", false, "Keep uploads and temporary files in memory and on tmpfs only, never on persistent disk")
+	scratchDir = flag.String("scratch-dir", "", "Directory for temporary files, which must be on tmpfs with --in-memory (default: the system temporary directory)")
+	jobWorkers = flag.Int("job-workers", 0, "Number of jobs processed at once (default: half the CPUs)")
+	jobQueue = flag.Int("job-queue", 64, "Number of jobs that may wait for a worker before new ones are refused")
+	jobTTL = flag.Duration("job-ttl", time.Hour, "How long finished jobs and their results are kept")
 }
 
 func main() {
 	flag.Parse()
 
-	// Create a temporary directory for output if it doesn't exist
-	tempOutputDir := filepath.Join(os.TempDir(), "media-privacy-output")
-	if _, err := os.Stat(tempOutputDir); os.IsNotExist(err) {
-		err = os.MkdirAll(tempOutputDir, 0755)
+	if *config != "" {
+		cfg, err := mediaprocessor.LoadConfig(*config)
 		if err != nil {
-			log.Fatalf("Failed to create temporary output directory: %v", err)
+			log.Fatalf("Invalid --config: %v", err)
+		}
+		defaultProfile = cfg.Profile
+		if cfg.Limits != nil {
+			limits = *cfg.Limits
 		}
 	}
 
-	http.HandleFunc("/scrub-metadata", handleScrubMetadata(tempOutputDir))
+	setUpScratch()
+	checkTranscoder()
+
+	http.HandleFunc("/scrub-metadata", handleScrubMetadata)
+	http.HandleFunc("/inspect", handleInspect)
+
+	if *jobQueue < 0 || *jobTTL <= 0 {
+		log.Fatalf("Invalid --job-queue or --job-ttl: must be positive")
+	}
+	workers := *jobWorkers
+	if workers <= 0 {
+		workers = max(runtime.NumCPU()/2, 1)
+	}
+	jobs = newJobStore(workers, *jobQueue, *jobTTL)
+	http.HandleFunc("POST /jobs", handleCreateJob)
+	http.HandleFunc("GET /jobs/{id}", handleGetJob)
+	http.HandleFunc("GET /jobs/{id}/result", handleJobResult)
+	http.HandleFunc("DELETE /jobs/{id}", handleDeleteJob)
 
 	log.Printf("Server is running on http://localhost:%d\n", *port)
 	log.Printf("Use the /scrub-metadata endpoint to process files\n")
+	log.Printf("Use the /inspect endpoint to report the metadata a file contains\n")
+	log.Printf("Use the /jobs endpoint to scrub files in the background with %d workers\n", workers)
 	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
 }
 
-func handleScrubMetadata(outputDir string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
+// setUpScratch gives the server a scratch directory of its own and wipes
+// the files crashed runs left in theirs. With --in-memory temporary files
+// are memory files, and the directory, which still takes the uploads
+// net/http spools to disk, must be on tmpfs.
+func setUpScratch() {
+	mediaprocessor.DefaultScratch = &mediaprocessor.Scratch{Dir: *scratchDir, InMemory: *inMemory}
+	if *inMemory {
+		if err := mediaprocessor.DefaultScratch.CheckInMemory(); err != nil {
+			log.Fatalf("Cannot keep uploads in memory: %v", err)
 		}
+	}
 
-		file, header, err := r.FormFile("file")
+	n, err := mediaprocessor.DefaultScratch.Claim("server")
+	if err != nil {
+		log.Fatalf("Error setting up the scratch directory: %v", err)
+	}
+	// Uploads net/http spools to disk land there too, to be swept after a
+	// crash
+	os.Setenv("TMPDIR", mediaprocessor.DefaultScratch.TempDir())
+	if *inMemory {
+		log.Printf("Keeping uploads in memory, with scratch files in %s\n", mediaprocessor.DefaultScratch.TempDir())
+	}
+	if n > 0 {
+		log.Printf("Wiped %d scratch files left by an earlier run\n", n)
+	}
+}
+
+// checkTranscoder detects FFmpeg and logs the profiles it can encode. A
+// default profile it cannot encode is fatal; without FFmpeg at all the
+// server still starts, scrubbing videos without a profile and answering
+// those with one with 503.
+func checkTranscoder() {
+	mediaprocessor.DefaultTranscoder = &mediaprocessor.FFmpeg{Path: *ffmpeg, ProbePath: *ffprobe}
+	caps, err := mediaprocessor.DefaultTranscoder.Capabilities(context.Background())
+	if err != nil {
+		if defaultProfile != "" {
+			log.Fatalf("Cannot transcode with the default profile: %v", err)
+		}
+		log.Printf("Warning: %v; video uploads with a profile will fail\n", err)
+		return
+	}
+	if defaultProfile != "" {
+		profile, err := mediaprocessor.ParseProfile(defaultProfile)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+			log.Fatalf("Invalid --config: %v", err)
 		}
-		defer file.Close()
+		if err := caps.CheckProfile(*profile); err != nil {
+			log.Fatalf("Invalid --config: %v", err)
+		}
+	}
+	log.Printf("Using FFmpeg %s with the profiles %s\n", caps.Version, strings.Join(caps.Profiles(), ", "))
+}
 
-		// Generate a unique filename
-		order := int(atomic.AddUint64(&fileCounter, 1))
-		outputFilename := mediaprocessor.GenerateOrderedFilename(order, filepath.Ext(header.Filename))
-		outputPath := filepath.Join(outputDir, outputFilename)
+func handleScrubMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", errors.New("method not allowed"))
+		return
+	}
 
-		// Create a temporary file to save the uploaded content
-		tempFile, err := os.CreateTemp("", "upload-*"+filepath.Ext(header.Filename))
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer os.Remove(tempFile.Name())
-		defer tempFile.Close()
+	scratch := mediaprocessor.DefaultScratch.NewJob()
+	defer scratch.Close()
 
-		// Copy the uploaded file to the temporary file
-		_, err = io.Copy(tempFile, file)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	file, header, err := formFile(w, r, scratch)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	defer file.Close()
 
-		// Process the file
-		err = mediaprocessor.ProcessLocalMediaFile(tempFile.Name(), outputPath)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	opts, err := scrubOptions(r)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	opts.Scratch = scratch
+
+	// Tracks are dropped before any output is written, so they can still be
+	// listed in the response headers
+	opts.TrackDropped = func(track mediaprocessor.DroppedTrack) {
+		log.Printf("Dropped %s track %d (%s) from %s", track.Type, track.Index, track.Codec, header.Filename)
+		w.Header().Add("X-Dropped-Track", droppedTrackHeader(track))
+	}
+
+	ext, err := resolveExt(w, file, header)
+	if err != nil {
+		processingError(w, err)
+		return
+	}
+
+	// Generate a unique filename
+	order := int(atomic.AddUint64(&fileCounter, 1))
+	outputFilename := mediaprocessor.GenerateOrderedFilename(order, ext, opts)
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(outputFilename)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", outputFilename))
+
+	// Scrub the upload straight into the response
+	err = mediaprocessor.Process(r.Context(), file, w, ext, opts)
+	if err != nil {
+		processingError(w, err)
+		return
+	}
+}
+
+// droppedTrackHeader describes a dropped track in an X-Dropped-Track header.
+func droppedTrackHeader(track mediaprocessor.DroppedTrack) string {
+	return fmt.Sprintf("%d; type=%s; codec=%s", track.Index, track.Type, track.Codec)
+}
+
+// scrubOptions reads how to scrub an upload from the form values of r.
+func scrubOptions(r *http.Request) (mediaprocessor.Options, error) {
+	// The policy may come from the query string or a form field
+	policy, err := mediaprocessor.ParsePolicy(r.FormValue("policy"))
+	if err != nil {
+		return mediaprocessor.Options{}, err
+	}
+
+	profileName := r.FormValue("profile")
+	if profileName == "" {
+		profileName = defaultProfile
+	}
+	profile, err := mediaprocessor.ParseProfile(profileName)
+	if err != nil {
+		return mediaprocessor.Options{}, err
+	}
+
+	// Regions to redact are given as JSON, in the same way as the policy
+	redaction, err := mediaprocessor.ParseRedaction(r.FormValue("redact"))
+	if err != nil {
+		return mediaprocessor.Options{}, err
+	}
+
+	var antiFingerprint float64
+	if value := r.FormValue("anti-fingerprint"); value != "" {
+		antiFingerprint, err = strconv.ParseFloat(value, 64)
+		if err != nil || antiFingerprint < 0 || antiFingerprint > 1 {
+			return mediaprocessor.Options{}, fmt.Errorf("invalid anti-fingerprint strength %q: must be between 0 and 1", value)
 		}
+	}
+
+	return mediaprocessor.Options{Timeout: *timeout, Policy: policy, Profile: profile, Redaction: redaction, AntiFingerprint: antiFingerprint, Limits: limits}, nil
+}
+
+func handleInspect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", errors.New("method not allowed"))
+		return
+	}
+
+	scratch := mediaprocessor.DefaultScratch.NewJob()
+	defer scratch.Close()
+
+	file, header, err := formFile(w, r, scratch)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	defer file.Close()
+
+	ext, err := resolveExt(w, file, header)
+	if err != nil {
+		processingError(w, err)
+		return
+	}
+
+	report, err := mediaprocessor.Inspect(r.Context(), file, ext)
+	if err != nil {
+		processingError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// formFile returns the upload in the file form field, refusing request
+// bodies and files over the input size limit before they are stored. If
+// net/http spooled the upload to disk, the scratch job wipes it.
+func formFile(w http.ResponseWriter, r *http.Request, scratch *mediaprocessor.ScratchJob) (multipart.File, *multipart.FileHeader, error) {
+	if limits.MaxInputBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxInputBytes+formOverhead)
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil, err
+	}
+	if spooled, ok := file.(*os.File); ok {
+		scratch.Track(spooled.Name())
+	}
+	if err := limits.CheckInputSize(header.Size); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, header, nil
+}
+
+// resolveExt returns the extension of the upload's detected format. When it
+// disagrees with the file name, the mismatch is logged and reported in an
+// X-Format-Mismatch response header.
+func resolveExt(w http.ResponseWriter, file multipart.File, header *multipart.FileHeader) (string, error) {
+	ext, mismatch, err := mediaprocessor.ResolveExt(file, filepath.Ext(header.Filename))
+	if err != nil {
+		return "", err
+	}
+	if mismatch != nil {
+		log.Printf("Format mismatch in %s: %s", header.Filename, mismatch)
+		w.Header().Set("X-Format-Mismatch", mismatch.String())
+	}
+	return ext, nil
+}
+
+// errorResponse is the JSON body of every error response. Code is the
+// mediaprocessor.ErrorCode of the error, or bad_request or
+// method_not_allowed when the request itself is at fault.
+type errorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	// TranscoderOutput is what FFmpeg or FFprobe printed when it failed
+	TranscoderOutput string `json:"transcoder_output,omitempty"`
+}
+
+// newErrorResponse returns the JSON body describing err.
+func newErrorResponse(code string, err error) errorResponse {
+	body := errorResponse{Code: code, Error: err.Error()}
+	var transcodeErr *mediaprocessor.TranscodeError
+	if errors.As(err, &transcodeErr) {
+		body.TranscoderOutput = transcodeErr.Stderr
+	}
+	return body
+}
+
+// writeError sends err as a JSON error response.
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	body := newErrorResponse(code, err)
+
+	// Drop the headers set for a successful download
+	w.Header().Del("Content-Disposition")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// badRequest sends a 400 response for invalid form values.
+func badRequest(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusBadRequest, "bad_request", err)
+}
+
+// processingError sends an error from mediaprocessor with the status for its
+// class.
+func processingError(w http.ResponseWriter, err error) {
+	code := mediaprocessor.ErrorCode(err)
+	writeError(w, mediaprocessor.HTTPStatus(code), code, err)
+}
 
-		// Serve the processed file
-		http.ServeFile(w, r, outputPath)
+// uploadError sends an error from formFile: 413 for uploads over a limit,
+// 400 for anything else wrong with the form.
+func uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, http.StatusRequestEntityTooLarge, "limit_exceeded", err)
+	case errors.Is(err, mediaprocessor.ErrLimitExceeded):
+		processingError(w, err)
+	default:
+		badRequest(w, err)
 	}
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lelopez-io/media-privacy-service/internal/mediaprocessor"
+)
+
+// fileIDPattern matches the IDs addFile hands out.
+var fileIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// addFile makes the processed file at path, relative to workdir/web,
+// downloadable by the session and returns its ID. Only the session that
+// uploaded a file learns its ID, and the ID says nothing about the path.
+func (sm *SessionManager) addFile(session *Session, path string) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating file ID: %w", err)
+	}
+	id := hex.EncodeToString(buf)
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if session.Files == nil {
+		session.Files = make(map[string]string)
+	}
+	session.Files[id] = path
+	return id, nil
+}
+
+// resolveFile returns the path of the file with the given ID among those of
+// the caller's session. Requests without a known session_id cookie have no
+// files. The path is checked to be an output of that session, so nothing
+// else under workdir/web is served, whatever the table holds.
+func (sm *SessionManager) resolveFile(r *http.Request, id string) (string, bool) {
+	if !fileIDPattern.MatchString(id) {
+		return "", false
+	}
+	cookie, err := r.Cookie("session_id")
+	if err != nil {
+		return "", false
+	}
+
+	sm.mutex.Lock()
+	session, found := sm.sessions[cookie.Value]
+	var path string
+	if found {
+		path, found = session.Files[id]
+	}
+	sm.mutex.Unlock()
+	if !found {
+		return "", false
+	}
+
+	// Expected: <session ID>/<hash>/output/<name>
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	if len(parts) != 4 || parts[0] != session.ID || parts[2] != "output" {
+		return "", false
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			return "", false
+		}
+	}
+	return filepath.Join("workdir", "web", path), true
+}
+
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/download/")
+
+	// Unknown IDs, other sessions' files and missing files all look the
+	// same, so IDs cannot be probed
+	filePath, found := sessionManager.resolveFile(r, id)
+	if !found {
+		writeError(w, http.StatusNotFound, "not_found", errors.New("File not found"))
+		return
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		writeError(w, http.StatusNotFound, "not_found", errors.New("File not found"))
+		return
+	}
+
+	// Serve the file under its own name, which the URL no longer carries
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(filePath)))
+	http.ServeFile(w, r, filePath)
+}
+
+func handleDownloadAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", errors.New("Method not allowed"))
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", errors.New("Failed to parse form"))
+		return
+	}
+
+	ids := r.Form["files"]
+	if len(ids) == 0 {
+		writeError(w, http.StatusBadRequest, "bad_request", errors.New("No files specified"))
+		return
+	}
+
+	// Create a temporary zip file, wiped once it is sent
+	scratch := mediaprocessor.DefaultScratch.NewJob()
+	defer scratch.Close()
+	tmpfile, err := scratch.CreateTemp("download-all-*.zip")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", errors.New("Failed to create temporary file"))
+		return
+	}
+
+	// Create a new zip archive
+	zipWriter := zip.NewWriter(tmpfile)
+
+	// Add specified files to the zip
+	for _, id := range ids {
+		filePath, found := sessionManager.resolveFile(r, id)
+		if !found {
+			continue // Skip files the session cannot download
+		}
+
+		// Check if file exists
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			continue // Skip if file doesn't exist
+		}
+
+		zipFile, err := zipWriter.Create(filepath.Base(filePath))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal", errors.New("Failed to create zip entry"))
+			return
+		}
+
+		fsFile, err := os.Open(filePath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal", errors.New("Failed to open file"))
+			return
+		}
+		defer fsFile.Close()
+
+		_, err = io.Copy(zipFile, fsFile)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal", errors.New("Failed to copy file to zip"))
+			return
+		}
+	}
+
+	err = zipWriter.Close()
+	if err == nil {
+		_, err = tmpfile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal", errors.New("Failed to write zip file"))
+		return
+	}
+
+	// Set headers for file download
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=selected_files.zip")
+
+	// Serve the zip file. Hiding the *os.File keeps net/http from using
+	// sendfile, which could still be reading it after it is wiped.
+	http.ServeContent(w, r, "selected_files.zip", time.Now(), struct{ io.ReadSeeker }{tmpfile})
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// errorResponse is the JSON body of every error response. Code is the
+// mediaprocessor.ErrorCode of the error, or one of bad_request,
+// method_not_allowed and not_found when the request itself is at fault.
+type errorResponse struct {
+	Code  string `json:"code"`
+	Error string `json:"error"`
+	// Files lists what went wrong with each file of an upload that failed
+	// as a whole
+	Files []fileError `json:"files,omitempty"`
+}
+
+// fileError is the error for one file of an upload.
+type fileError struct {
+	File  string `json:"file"`
+	Code  string `json:"code"`
+	Error string `json:"error"`
+}
+
+// writeJSONError sends body as a JSON error response.
+func writeJSONError(w http.ResponseWriter, status int, body errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError sends err as a JSON error response.
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	writeJSONError(w, status, errorResponse{Code: code, Error: err.Error()})
+}
+
+// formError sends an error from parsing a form: 413 if the body was over
+// its size limit, 400 otherwise.
+func formError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "limit_exceeded", err)
+		return
+	}
+	writeError(w, http.StatusBadRequest, "bad_request", err)
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"archive/zip"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -22,9 +23,17 @@ import (
 )
 
 type Session struct {
-	ID           string
+	ID string
+	// FileCounter is the number of the session's latest output file.
+	// Guarded by SessionManager.mutex.
 	FileCounter  int
 	LastAccessed time.Time
+	// Files maps the IDs of the session's downloads to their paths under
+	// workdir/web. Guarded by SessionManager.mutex.
+	Files map[string]string
+	// uploads counts the uploads in progress, which retention leaves
+	// alone. Guarded by SessionManager.mutex.
+	uploads int
 }
 
 type SessionManager struct {
@@ -34,10 +43,57 @@ type SessionManager struct {
 
 var sessionManager *SessionManager
 
+// fileTimeout bounds how long a single uploaded file may take to process.
+var fileTimeout time.Duration
+
+// formOverhead is the room left in request bodies for the multipart
+// encoding and the other form fields around the uploads.
+const formOverhead = 1 << 20
+
 func main() {
 	cleanWorkdir := flag.Bool("clean", false, "Clean the workdir before starting the server")
+	flag.DurationVar(&fileTimeout, "timeout", 10*time.Minute, "Maximum time to spend processing a single uploaded file")
+	ffmpeg := flag.String("ffmpeg", "", "Path to the ffmpeg program (default: found on PATH)")
+	ffprobe := flag.String("ffprobe", "", "Path to the ffprobe program (default: found on PATH)")
+	fileTTL := flag.Duration("retention", 24*time.Hour, "How long uploaded and processed files are kept on disk")
+	quotaMB := flag.Int64("disk-quota-mb", 0, "Megabytes of uploaded and processed files to keep before deleting the oldest (0 for no limit)")
+	inMemory := flag.Bool("in-memory", false, "Keep uploaded originals and temporary files in memory and on tmpfs only, never on persistent disk")
+	scratchDir := flag.String("scratch-dir", "", "Directory for temporary files, which must be on tmpfs with --in-memory (default: the system temporary directory)")
 	flag.Parse()
 
+	if *fileTTL <= 0 {
+		log.Fatalf("Invalid --retention: %s is not positive", *fileTTL)
+	}
+	if *quotaMB < 0 {
+		log.Fatalf("Invalid --disk-quota-mb: %d is negative", *quotaMB)
+	}
+
+	// Uploads are staged in scratch files, and those too large for memory
+	// are spooled by net/http to the temporary directory, so it is pointed
+	// at the scratch directory, which --in-memory requires to be on tmpfs.
+	mediaprocessor.DefaultScratch = &mediaprocessor.Scratch{Dir: *scratchDir, InMemory: *inMemory}
+	if *inMemory {
+		if err := mediaprocessor.DefaultScratch.CheckInMemory(); err != nil {
+			log.Fatalf("Cannot keep uploads in memory: %v", err)
+		}
+	}
+	if n, err := mediaprocessor.DefaultScratch.Claim("webserver"); err != nil {
+		log.Fatalf("Error setting up the scratch directory: %v", err)
+	} else if n > 0 {
+		log.Printf("Wiped %d scratch files left by an earlier run", n)
+	}
+	os.Setenv("TMPDIR", mediaprocessor.DefaultScratch.TempDir())
+	if *inMemory {
+		log.Printf("Keeping uploads in memory, with scratch files in %s", mediaprocessor.DefaultScratch.TempDir())
+	}
+
+	// Videos are scrubbed in place, and verified with FFprobe when it is
+	// there
+	mediaprocessor.DefaultTranscoder = &mediaprocessor.FFmpeg{Path: *ffmpeg, ProbePath: *ffprobe}
+	if _, err := mediaprocessor.DefaultTranscoder.Capabilities(context.Background()); err != nil {
+		log.Printf("Warning: %v; video uploads are verified without it", err)
+	}
+
 	if *cleanWorkdir {
 		err := cleanWorkDir()
 		if err != nil {
@@ -50,10 +106,17 @@ func main() {
 		sessions: make(map[string]*Session),
 	}
 
-	go sessionManager.cleanupSessions()
+	// Also deletes what earlier runs left behind, which no session can
+	// download any more
+	go sessionManager.cleanupSessions(retention{
+		dir:     filepath.Join("workdir", "web"),
+		fileTTL: *fileTTL,
+		quota:   *quotaMB << 20,
+	})
 
 	http.HandleFunc("/", handleHome)
 	http.HandleFunc("/upload", handleUpload)
+	http.HandleFunc("/progress", handleProgress)
 	http.HandleFunc("/download/", handleDownload)
 	http.HandleFunc("/download-all", handleDownloadAll)
 
@@ -62,75 +125,6 @@ func main() {
 	http.ListenAndServe(":8080", nil)
 }
 
-func handleDownloadAll(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	err := r.ParseForm()
-	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
-		return
-	}
-
-	filenames := r.Form["filenames"]
-	if len(filenames) == 0 {
-		http.Error(w, "No files specified", http.StatusBadRequest)
-		return
-	}
-
-	// Create a temporary zip file
-	tmpfile, err := ioutil.TempFile("", "download-all-*.zip")
-	if err != nil {
-		http.Error(w, "Failed to create temporary file", http.StatusInternalServerError)
-		return
-	}
-	defer os.Remove(tmpfile.Name())
-
-	// Create a new zip archive
-	zipWriter := zip.NewWriter(tmpfile)
-
-	// Add specified files to the zip
-	for _, filename := range filenames {
-		filePath := filepath.Join("workdir", "web", filename)
-
-		// Check if file exists
-		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			continue // Skip if file doesn't exist
-		}
-
-		zipFile, err := zipWriter.Create(filepath.Base(filename))
-		if err != nil {
-			http.Error(w, "Failed to create zip entry", http.StatusInternalServerError)
-			return
-		}
-
-		fsFile, err := os.Open(filePath)
-		if err != nil {
-			http.Error(w, "Failed to open file", http.StatusInternalServerError)
-			return
-		}
-		defer fsFile.Close()
-
-		_, err = io.Copy(zipFile, fsFile)
-		if err != nil {
-			http.Error(w, "Failed to copy file to zip", http.StatusInternalServerError)
-			return
-		}
-	}
-
-	zipWriter.Close()
-	tmpfile.Close()
-
-	// Set headers for file download
-	w.Header().Set("Content-Type", "application/zip")
-	w.Header().Set("Content-Disposition", "attachment; filename=selected_files.zip")
-
-	// Serve the zip file
-	http.ServeFile(w, r, tmpfile.Name())
-}
-
 func cleanWorkDir() error {
 	workdir := filepath.Join("workdir", "web")
 	err := os.RemoveAll(workdir)
@@ -140,66 +134,72 @@ func cleanWorkDir() error {
 	return os.MkdirAll(workdir, os.ModePerm)
 }
 
-func handleDownload(w http.ResponseWriter, r *http.Request) {
-	filename := r.URL.Path[len("/download/"):]
-	filePath := filepath.Join("workdir", "web", filename)
+// beginUpload and endUpload bracket an upload to the session.
+func (sm *SessionManager) beginUpload(session *Session) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session.uploads++
+}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
-		return
-	}
+func (sm *SessionManager) endUpload(session *Session) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session.uploads--
+}
+
+// nextFileNumber reserves the number of the session's next output file.
+func (sm *SessionManager) nextFileNumber(session *Session) int {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session.FileCounter++
+	return session.FileCounter
+}
 
-	// Serve the file
-	http.ServeFile(w, r, filePath)
+// releaseFileNumber gives back a number from nextFileNumber whose file was
+// not processed. Only the latest number is reused, so a number taken by
+// another file since is never handed out twice.
+func (sm *SessionManager) releaseFileNumber(session *Session, number int) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	if session.FileCounter == number {
+		session.FileCounter--
+	}
 }
 
 func (sm *SessionManager) getSession(w http.ResponseWriter, r *http.Request) *Session {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
 
+	// Session IDs are only ever chosen here, so a client cannot pick
+	// another's
 	cookie, err := r.Cookie("session_id")
-	if err != nil {
-		sessionID := uuid.New().String()
-		session := &Session{ID: sessionID, FileCounter: 0, LastAccessed: time.Now()}
-		sm.sessions[sessionID] = session
-
-		http.SetCookie(w, &http.Cookie{
-			Name:    "session_id",
-			Value:   sessionID,
-			Expires: time.Now().Add(24 * time.Hour),
-		})
-
-		return session
+	if err == nil {
+		if session, found := sm.sessions[cookie.Value]; found {
+			session.LastAccessed = time.Now()
+			return session
+		}
 	}
 
-	session, found := sm.sessions[cookie.Value]
-	if !found {
-		session = &Session{ID: cookie.Value, FileCounter: 0, LastAccessed: time.Now()}
-		sm.sessions[cookie.Value] = session
-	}
+	sessionID := uuid.New().String()
+	session := &Session{ID: sessionID, FileCounter: 0, LastAccessed: time.Now()}
+	sm.sessions[sessionID] = session
 
-	session.LastAccessed = time.Now()
-	return session
-}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_id",
+		Value:    sessionID,
+		Path:     "/",
+		Expires:  time.Now().Add(24 * time.Hour),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
 
-func (sm *SessionManager) cleanupSessions() {
-	for {
-		time.Sleep(1 * time.Hour)
-		sm.mutex.Lock()
-		for id, session := range sm.sessions {
-			if time.Since(session.LastAccessed) > 24*time.Hour {
-				delete(sm.sessions, id)
-			}
-		}
-		sm.mutex.Unlock()
-	}
+	return session
 }
 
 func handleHome(w http.ResponseWriter, r *http.Request) {
 	tmpl, err := template.ParseFiles("templates/index.html")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal", err)
 		return
 	}
 	tmpl.Execute(w, nil)
@@ -207,132 +207,142 @@ func handleHome(w http.ResponseWriter, r *http.Request) {
 
 func handleUpload(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", errors.New("Method not allowed"))
 		return
 	}
 
+	// The parts net/http spools to disk are bounded along with the body
+	limits := mediaprocessor.DefaultLimits
+	if limits.MaxInputBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, limits.MaxInputBytes+formOverhead)
+	}
+
 	// Parse the multipart form data
 	err := r.ParseMultipartForm(32 << 20) // 32 MB max memory
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		formError(w, err)
 		return
 	}
 
+	// Every copy of the uploads is wiped once they are processed, including
+	// those net/http spooled to disk
+	scratch := mediaprocessor.DefaultScratch.NewJob()
+	defer scratch.Close()
+
 	// Get the session
 	session := sessionManager.getSession(w, r)
 
+	policy, err := mediaprocessor.ParsePolicy(r.FormValue("policy"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err)
+		return
+	}
+	opts := mediaprocessor.Options{Timeout: fileTimeout, Policy: policy, Limits: limits, Scratch: scratch}
+
+	// Clients following the upload on /progress name it with an ID of their
+	// choosing
+	var progress *uploadProgress
+	if uploadID := r.FormValue("upload-id"); uploadIDPattern.MatchString(uploadID) {
+		progress = progressHub.acquire(uploadID)
+		defer progressHub.release(uploadID, progress)
+		defer progress.finish()
+	}
+
 	// Get the files from the request
 	files := r.MultipartForm.File["file-input"]
 
-	type ProcessedFile struct {
-		Index    int
-		Filename string
-		Error    string
-	}
-
 	processedFiles := make([]ProcessedFile, len(files))
-	var wg sync.WaitGroup
 
-	// Pre-assign file counters
-	fileCounters := make([]int, len(files))
-	for i := range files {
-		session.FileCounter++
-		fileCounters[i] = session.FileCounter
-	}
-
-	// Create a buffered channel to limit concurrency
-	semaphore := make(chan struct{}, 5) // Adjust this number based on your needs
+	sessionManager.beginUpload(session)
+	defer sessionManager.endUpload(session)
 
+	// Files are staged in the session one at a time, then those not
+	// processed before go through the batch; indexes maps each batch item
+	// back to its file
+	var items []mediaprocessor.BatchItem
+	var indexes []int
+	var numbers []int
 	for i, fileHeader := range files {
-		wg.Add(1)
-		go func(i int, fileHeader *multipart.FileHeader, fileCounter int) {
-			defer wg.Done()
-			semaphore <- struct{}{}        // Acquire semaphore
-			defer func() { <-semaphore }() // Release semaphore
-
-			file, err := fileHeader.Open()
-			if err != nil {
-				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error opening file %s: %v", fileHeader.Filename, err)}
-				return
-			}
-			defer file.Close()
-
-			// Read the file content
-			fileContent, err := ioutil.ReadAll(file)
-			if err != nil {
-				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error reading file %s: %v", fileHeader.Filename, err)}
-				return
-			}
-
-			// Calculate hash of the file content
-			hash := sha256.Sum256(fileContent)
-			hashString := hex.EncodeToString(hash[:])
-
-			// Create session directory
-			sessionDir := filepath.Join("workdir", "web", session.ID)
-			err = os.MkdirAll(sessionDir, os.ModePerm)
-			if err != nil {
-				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error creating session directory: %v", err)}
-				return
-			}
-
-			// Create hash directory
-			hashDir := filepath.Join(sessionDir, hashString)
-			err = os.MkdirAll(filepath.Join(hashDir, "input"), os.ModePerm)
-			err = os.MkdirAll(filepath.Join(hashDir, "output"), os.ModePerm)
-			if err != nil {
-				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error creating hash directory: %v", err)}
-				return
-			}
-
-			inputPath := filepath.Join(hashDir, "input", fileHeader.Filename)
-			outputDir := filepath.Join(hashDir, "output")
-
-			// Check if any file exists in the output directory
-			outputFiles, err := ioutil.ReadDir(outputDir)
-			if err == nil && len(outputFiles) > 0 {
-				// File already processed
-				processedFiles[i] = ProcessedFile{Index: i, Filename: filepath.Join(session.ID, hashString, "output", outputFiles[0].Name())}
-				session.FileCounter-- // Decrement the file counter if the file is not processed
-				return
-			}
-
-			// Write the file content to the input file
-			err = ioutil.WriteFile(inputPath, fileContent, 0644)
-			if err != nil {
-				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error writing input file for %s: %v", fileHeader.Filename, err)}
-				session.FileCounter-- // Decrement the file counter if the file is not processed
-				return
-			}
+		number := sessionManager.nextFileNumber(session)
+		item, pf, staged := stageUpload(session, fileHeader, number, policy, opts)
+		pf.Index = i
+		processedFiles[i] = pf
+		if !staged {
+			sessionManager.releaseFileNumber(session, number)
+			continue
+		}
+		items = append(items, item)
+		indexes = append(indexes, i)
+		numbers = append(numbers, number)
+	}
 
-			// Process the file
-			outputFilename := mediaprocessor.GenerateOrderedFilename(fileCounter, filepath.Ext(fileHeader.Filename))
-			outputPath := filepath.Join(outputDir, outputFilename)
-			err = mediaprocessor.ProcessLocalMediaFile(inputPath, outputPath)
-			if err != nil {
-				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error processing file %s: %v", fileHeader.Filename, err)}
-				session.FileCounter-- // Decrement the file counter if the file is not processed
-				return
+	batch := mediaprocessor.Batch{
+		Concurrency: 5, // Adjust this number based on your needs
+		Options:     opts,
+		OnEvent: func(event mediaprocessor.BatchEvent) {
+			i := indexes[event.Index]
+			switch event.Type {
+			case mediaprocessor.EventProgress:
+				if progress != nil {
+					progress.set(i, int(event.Percent))
+				}
+			case mediaprocessor.EventDone:
+				for _, track := range event.Dropped {
+					log.Printf("Dropped %s track %d (%s) from %s", track.Type, track.Index, track.Codec, event.Item.Name)
+				}
+			case mediaprocessor.EventFailed:
+				processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error processing file %s: %v", event.Item.Name, event.Err), Code: mediaprocessor.ErrorCode(event.Err)}
+				sessionManager.releaseFileNumber(session, numbers[event.Index])
 			}
+		},
+	}
+	batch.Run(r.Context(), items)
 
-			processedFiles[i] = ProcessedFile{Index: i, Filename: filepath.Join(session.ID, hashString, "output", outputFilename)}
-		}(i, fileHeader, fileCounters[i])
+	// Outputs are downloaded by ID, never by path
+	for i, pf := range processedFiles {
+		if pf.Error != "" {
+			continue
+		}
+		id, err := sessionManager.addFile(session, pf.Filename)
+		if err != nil {
+			processedFiles[i] = ProcessedFile{Index: i, Error: fmt.Sprintf("Error processing file %s: %v", files[i].Filename, err), Code: mediaprocessor.ErrorCode(err)}
+			continue
+		}
+		processedFiles[i].ID = id
 	}
 
-	wg.Wait()
+	// An upload where every file failed is an error as a whole, sent with
+	// the status of the first failure
+	var failures []fileError
+	for i, pf := range processedFiles {
+		if pf.Error != "" {
+			failures = append(failures, fileError{File: files[i].Filename, Code: pf.Code, Error: pf.Error})
+		}
+	}
+	if len(failures) > 0 && len(failures) == len(processedFiles) {
+		for _, failure := range failures {
+			fmt.Println(failure.Error)
+		}
+		writeJSONError(w, mediaprocessor.HTTPStatus(failures[0].Code), errorResponse{Code: failures[0].Code, Error: failures[0].Error, Files: failures})
+		return
+	}
 
 	// Return the processed files information and any errors
 	w.Header().Set("Content-Type", "text/html")
 	for _, pf := range processedFiles {
 		if pf.Error != "" {
-			fmt.Fprintf(w, "<li class='text-red-500 py-2'>%s</li>", pf.Error)
+			fmt.Fprintf(w, "<li class='text-red-500 py-2' data-error-code='%s'>%s</li>", template.HTMLEscapeString(pf.Code), template.HTMLEscapeString(pf.Error))
 		} else {
-			downloadPath := filepath.Join("/download", pf.Filename)
+			downloadPath := "/download/" + pf.ID
+			var warning string
+			if pf.Warning != "" {
+				warning = fmt.Sprintf(" <span class='text-yellow-600'>(%s)</span>", template.HTMLEscapeString(pf.Warning))
+			}
 			fmt.Fprintf(w, "<li class='flex justify-between items-center py-2'>"+
-				"<span>File processed: %s</span>"+
+				"<span>File processed: %s%s</span>"+
 				"<a href='%s' download class='text-blue-500 hover:text-blue-700'>"+
 				"<svg xmlns='http://www.w3.org/2000/svg' width='24' height='24' viewBox='0 0 24 24' fill='none' stroke='currentColor' stroke-width='2' stroke-linecap='round' stroke-linejoin='round' class='feather feather-download'><path d='M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4'></path><polyline points='7 10 12 15 17 10'></polyline><line x1='12' y1='15' x2='12' y2='3'></line></svg>"+
-				"</a></li>", filepath.Base(pf.Filename), downloadPath)
+				"</a></li>", filepath.Base(pf.Filename), warning, downloadPath)
 		}
 	}
 
@@ -343,3 +353,103 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// ProcessedFile is the outcome of one uploaded file.
+type ProcessedFile struct {
+	Index int
+	// Filename is the path of the output under workdir/web
+	Filename string
+	// ID is what the session downloads the output by
+	ID    string
+	Error string
+	// Code classifies Error, as mediaprocessor.ErrorCode does
+	Code string
+	// Warning notes a file whose content did not match its extension
+	Warning string
+}
+
+// stageUpload copies an uploaded file into a file of opts.Scratch, to be
+// processed into the session's workdir under the hash of its content and
+// the policy applied to it. The returned item processes it, unless staged is
+// false: the file was already processed with the same policy, and pf names
+// the earlier output, or it could not be staged, and pf holds the error.
+func stageUpload(session *Session, fileHeader *multipart.FileHeader, fileCounter int, policy mediaprocessor.Policy, opts mediaprocessor.Options) (item mediaprocessor.BatchItem, pf ProcessedFile, staged bool) {
+	fail := func(message string, err error) (mediaprocessor.BatchItem, ProcessedFile, bool) {
+		return item, ProcessedFile{Error: fmt.Sprintf("%s: %v", message, err), Code: mediaprocessor.ErrorCode(err)}, false
+	}
+
+	// Files over the size limit are refused before they are copied
+	if err := opts.Limits.CheckInputSize(fileHeader.Size); err != nil {
+		return fail("Error processing file "+fileHeader.Filename, err)
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return fail("Error opening file "+fileHeader.Filename, err)
+	}
+	defer file.Close()
+	if spooled, ok := file.(*os.File); ok {
+		opts.Scratch.Track(spooled.Name())
+	}
+
+	// The content decides how the file is processed and named
+	ext, mismatch, err := mediaprocessor.ResolveExt(file, filepath.Ext(fileHeader.Filename))
+	if err != nil {
+		return fail("Error reading file "+fileHeader.Filename, err)
+	}
+	var warning string
+	if mismatch != nil {
+		warning = mismatch.String()
+		log.Printf("Format mismatch in %s: %s", fileHeader.Filename, warning)
+	}
+
+	// Calculate hash of the file content and the policy applied to it
+	hasher := sha256.New()
+	io.WriteString(hasher, policy.String())
+	_, err = io.Copy(hasher, file)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fail("Error reading file "+fileHeader.Filename, err)
+	}
+	hashString := hex.EncodeToString(hasher.Sum(nil))
+
+	// Create session directory
+	sessionDir := filepath.Join("workdir", "web", session.ID)
+	err = os.MkdirAll(sessionDir, os.ModePerm)
+	if err != nil {
+		return fail("Error creating session directory", err)
+	}
+
+	// Create hash directory
+	hashDir := filepath.Join(sessionDir, hashString)
+	err = os.MkdirAll(filepath.Join(hashDir, "output"), os.ModePerm)
+	if err != nil {
+		return fail("Error creating hash directory", err)
+	}
+
+	outputDir := filepath.Join(hashDir, "output")
+
+	// Check if any file exists in the output directory
+	outputFiles, err := ioutil.ReadDir(outputDir)
+	if err == nil && len(outputFiles) > 0 {
+		// File already processed
+		return item, ProcessedFile{Filename: filepath.Join(session.ID, hashString, "output", outputFiles[0].Name()), Warning: warning}, false
+	}
+
+	// Write the file content to the input file
+	input, err := opts.Scratch.CreateTemp("upload-*" + ext)
+	if err == nil {
+		_, err = io.Copy(input, file)
+	}
+	if err != nil {
+		return fail("Error writing input file for "+fileHeader.Filename, err)
+	}
+	inputPath := input.Name()
+
+	outputFilename := mediaprocessor.GenerateOrderedFilename(fileCounter, ext, opts)
+	item = mediaprocessor.BatchItem{Name: fileHeader.Filename, InputPath: inputPath, OutputPath: filepath.Join(outputDir, outputFilename)}
+	pf = ProcessedFile{Filename: filepath.Join(session.ID, hashString, "output", outputFilename), Warning: warning}
+	return item, pf, true
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// uploadIDPattern restricts the IDs clients may choose for an upload.
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// uploadProgress tracks the percent complete of each file in an upload.
+type uploadProgress struct {
+	mu      sync.Mutex
+	percent map[int]int
+	done    bool
+	// changed is closed and replaced whenever the progress changes
+	changed chan struct{}
+
+	refs int // guarded by ProgressHub.mutex
+}
+
+func (p *uploadProgress) set(index, percent int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.percent[index] == percent {
+		return
+	}
+	p.percent[index] = percent
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *uploadProgress) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done = true
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// snapshot returns a copy of the current progress and a channel that is
+// closed on the next change.
+func (p *uploadProgress) snapshot() (map[int]int, bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	percent := make(map[int]int, len(p.percent))
+	for index, value := range p.percent {
+		percent[index] = value
+	}
+	return percent, p.done, p.changed
+}
+
+// ProgressHub connects uploads with the clients following their progress.
+// Either side may arrive first; an entry lives while either holds it.
+type ProgressHub struct {
+	uploads map[string]*uploadProgress
+	mutex   sync.Mutex
+}
+
+var progressHub = &ProgressHub{uploads: make(map[string]*uploadProgress)}
+
+func (h *ProgressHub) acquire(id string) *uploadProgress {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	p, found := h.uploads[id]
+	if !found {
+		p = &uploadProgress{percent: make(map[int]int), changed: make(chan struct{})}
+		h.uploads[id] = p
+	}
+	p.refs++
+	return p
+}
+
+func (h *ProgressHub) release(id string, p *uploadProgress) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	p.refs--
+	if p.refs == 0 {
+		delete(h.uploads, id)
+	}
+}
+
+// handleProgress streams the progress of the upload named by the id query
+// parameter as server-sent events, until the upload is done or the client
+// goes away.
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if !uploadIDPattern.MatchString(id) {
+		writeError(w, http.StatusBadRequest, "bad_request", errors.New("Invalid upload ID"))
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "internal", errors.New("Streaming not supported"))
+		return
+	}
+
+	progress := progressHub.acquire(id)
+	defer progressHub.release(id, progress)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sent := map[int]int{}
+	for {
+		percent, done, changed := progress.snapshot()
+
+		indexes := make([]int, 0, len(percent))
+		for index := range percent {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+		for _, index := range indexes {
+			if value, found := sent[index]; found && value == percent[index] {
+				continue
+			}
+			data, _ := json.Marshal(struct {
+				Index   int `json:"index"`
+				Percent int `json:"percent"`
+			}{index, percent[index]})
+			fmt.Fprintf(w, "event: progress\ndata: %s\n\n", data)
+			sent[index] = percent[index]
+		}
+		if done {
+			fmt.Fprint(w, "event: done\ndata: {}\n\n")
+		}
+		flusher.Flush()
+		if done {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
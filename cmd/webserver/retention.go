@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// sessionTTL is how long a session lasts after its last request.
+const sessionTTL = 24 * time.Hour
+
+// emptyDirGrace keeps freshly created upload directories from being pruned
+// before the upload is written into them.
+const emptyDirGrace = time.Minute
+
+// retention bounds what the webserver keeps under workdir/web: the
+// directory of a session goes when the session expires, every file goes
+// once it is fileTTL old, and the oldest files go first when the total is
+// over quota.
+type retention struct {
+	dir     string
+	fileTTL time.Duration
+	quota   int64 // bytes, 0 for no limit
+}
+
+// interval is how often the retention is enforced.
+func (rt retention) interval() time.Duration {
+	return min(max(rt.fileTTL/4, time.Second), time.Hour)
+}
+
+// sweepStats counts what a sweep deleted.
+type sweepStats struct {
+	sessions int
+	expired  int
+	evicted  int
+	bytes    int64
+}
+
+func (sm *SessionManager) cleanupSessions(rt retention) {
+	for {
+		sm.sweep(rt, time.Now())
+		time.Sleep(rt.interval())
+	}
+}
+
+// sweep expires sessions and deletes the files retention no longer allows,
+// logging how many it deleted.
+func (sm *SessionManager) sweep(rt retention, now time.Time) {
+	sm.mutex.Lock()
+	for id, session := range sm.sessions {
+		if now.Sub(session.LastAccessed) > sessionTTL {
+			delete(sm.sessions, id)
+		}
+	}
+	sm.mutex.Unlock()
+
+	var stats sweepStats
+
+	// The directories of expired sessions go as a whole, and so do those
+	// of sessions from before a restart, whose file IDs are lost. Sessions
+	// exist before their directories, so one created meanwhile is kept.
+	entries, err := os.ReadDir(rt.dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Retention: error reading %s: %v", rt.dir, err)
+		return
+	}
+	for _, entry := range entries {
+		sm.mutex.Lock()
+		_, live := sm.sessions[entry.Name()]
+		sm.mutex.Unlock()
+		if live {
+			continue
+		}
+		path := filepath.Join(rt.dir, entry.Name())
+		files, size := diskUsage(path)
+		if err := os.RemoveAll(path); err != nil {
+			log.Printf("Retention: error deleting %s: %v", path, err)
+			continue
+		}
+		stats.sessions++
+		stats.expired += files
+		stats.bytes += size
+	}
+
+	// What is left is deleted once it is too old, then oldest first while
+	// the total is over the quota
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var kept []file
+	var total int64
+	entries, _ = os.ReadDir(rt.dir)
+	for _, entry := range entries {
+		// Uploads in progress are left alone, as their files may not all
+		// be there yet
+		if sm.busy(entry.Name()) {
+			continue
+		}
+		filepath.WalkDir(filepath.Join(rt.dir, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return nil // Deleted under us, or nothing to delete yet
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			if now.Sub(info.ModTime()) > rt.fileTTL {
+				if os.Remove(path) == nil {
+					stats.expired++
+					stats.bytes += info.Size()
+				}
+				return nil
+			}
+			kept = append(kept, file{path: path, size: info.Size(), modTime: info.ModTime()})
+			total += info.Size()
+			return nil
+		})
+	}
+
+	if rt.quota > 0 && total > rt.quota {
+		sort.Slice(kept, func(i, j int) bool { return kept[i].modTime.Before(kept[j].modTime) })
+		for _, f := range kept {
+			if total <= rt.quota {
+				break
+			}
+			if os.Remove(f.path) == nil {
+				stats.evicted++
+				stats.bytes += f.size
+				total -= f.size
+			}
+		}
+	}
+
+	sm.pruneEmptyDirs(rt.dir, now)
+
+	if stats.sessions > 0 || stats.expired > 0 || stats.evicted > 0 {
+		log.Printf("Retention: deleted %d session directories, %d expired and %d evicted files, %d bytes in all",
+			stats.sessions, stats.expired, stats.evicted, stats.bytes)
+	}
+}
+
+// busy reports whether the session has uploads in progress.
+func (sm *SessionManager) busy(id string) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	session, found := sm.sessions[id]
+	return found && session.uploads > 0
+}
+
+// pruneEmptyDirs deletes the upload directories under dir that no longer
+// hold any file, whose names are hashes of what was uploaded, then the
+// session directories left empty.
+func (sm *SessionManager) pruneEmptyDirs(dir string, now time.Time) {
+	old := func(path string) bool {
+		info, err := os.Stat(path)
+		return err == nil && now.Sub(info.ModTime()) > emptyDirGrace
+	}
+	sessions, _ := os.ReadDir(dir)
+	for _, session := range sessions {
+		if sm.busy(session.Name()) {
+			continue
+		}
+		sessionDir := filepath.Join(dir, session.Name())
+		uploads, _ := os.ReadDir(sessionDir)
+		for _, upload := range uploads {
+			uploadDir := filepath.Join(sessionDir, upload.Name())
+			if files, _ := diskUsage(uploadDir); files == 0 && old(uploadDir) {
+				os.RemoveAll(uploadDir)
+			}
+		}
+		if old(sessionDir) {
+			os.Remove(sessionDir) // Fails unless empty
+		}
+	}
+}
+
+// diskUsage counts the files under path and their total size.
+func diskUsage(path string) (files int, size int64) {
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				files++
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return files, size
+}
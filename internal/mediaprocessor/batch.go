@@ -0,0 +1,219 @@
+package mediaprocessor
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// BatchItem is one file of a Batch.
+type BatchItem struct {
+	// Name identifies the item to people, such as the uploaded file name.
+	// Empty uses InputPath.
+	Name string
+	// InputPath is the file to process.
+	InputPath string
+	// OutputPath is where the scrubbed file is written.
+	OutputPath string
+}
+
+func (item BatchItem) name() string {
+	if item.Name != "" {
+		return item.Name
+	}
+	return item.InputPath
+}
+
+// BatchEventType is the kind of a BatchEvent.
+type BatchEventType int
+
+const (
+	// EventQueued is sent for every item, in order, before any starts.
+	EventQueued BatchEventType = iota
+	// EventStarted is sent when a worker starts processing the item. Items
+	// in an unsupported format fail without starting.
+	EventStarted
+	// EventProgress reports how far the item has got.
+	EventProgress
+	// EventDone is sent once the item's output is written and verified.
+	EventDone
+	// EventFailed is sent when the item cannot be processed, or is never
+	// started because the batch was cancelled.
+	EventFailed
+)
+
+func (t BatchEventType) String() string {
+	switch t {
+	case EventQueued:
+		return "queued"
+	case EventStarted:
+		return "started"
+	case EventProgress:
+		return "progress"
+	case EventDone:
+		return "done"
+	case EventFailed:
+		return "failed"
+	}
+	return fmt.Sprintf("BatchEventType(%d)", int(t))
+}
+
+// BatchEvent reports a change in the state of one item of a Batch.
+type BatchEvent struct {
+	Type BatchEventType
+	// Index is the position of the item in the list given to Run.
+	Index int
+	Item  BatchItem
+	// Percent is how much of the item is processed, for EventProgress.
+	Percent float64
+	// Mismatch is set, from EventStarted on, for a file whose extension
+	// does not match its content.
+	Mismatch *FormatMismatch
+	// Dropped lists the tracks removed from a video, for EventDone.
+	Dropped []DroppedTrack
+	// Err is why the item failed, for EventFailed.
+	Err error
+}
+
+// BatchResult is the outcome of one item of a Batch.
+type BatchResult struct {
+	Item BatchItem
+	// Err is nil if the item was processed.
+	Err      error
+	Mismatch *FormatMismatch
+	Dropped  []DroppedTrack
+	Elapsed  time.Duration
+}
+
+// BatchSummary is what Batch.Run returns once every item is finished.
+type BatchSummary struct {
+	// Results holds one result per item, in the order given to Run.
+	Results   []BatchResult
+	Succeeded int
+	Failed    int
+	Elapsed   time.Duration
+}
+
+// Batch processes many files with a fixed number of workers, reporting each
+// step as a BatchEvent.
+type Batch struct {
+	// Concurrency is how many files are processed at once. Zero or less
+	// uses half the CPUs, and at least one worker always runs.
+	Concurrency int
+
+	// Options apply to every file. Their Progress and TrackDropped
+	// callbacks, if set, are called as well as the events being sent.
+	Options Options
+
+	// OnEvent, if set, is called for every event. Calls are never
+	// concurrent, so it may update state without locking, but it should
+	// return quickly as the workers wait for it.
+	OnEvent func(BatchEvent)
+}
+
+func (b *Batch) workers(items int) int {
+	n := b.Concurrency
+	if n <= 0 {
+		n = runtime.NumCPU() / 2
+	}
+	return max(min(n, items), 1)
+}
+
+// Run processes items with ProcessLocalMediaFile and returns once all of
+// them have finished. Cancelling ctx stops the files being processed, and
+// those not yet started fail with the context's error.
+func (b *Batch) Run(ctx context.Context, items []BatchItem) BatchSummary {
+	start := time.Now()
+	summary := BatchSummary{Results: make([]BatchResult, len(items))}
+
+	var mu sync.Mutex
+	emit := func(event BatchEvent) {
+		if b.OnEvent == nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		b.OnEvent(event)
+	}
+
+	for i, item := range items {
+		summary.Results[i].Item = item
+		emit(BatchEvent{Type: EventQueued, Index: i, Item: item})
+	}
+
+	queue := make(chan int, len(items))
+	for i := range items {
+		queue <- i
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	for range b.workers(len(items)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				summary.Results[i] = b.process(ctx, i, items[i], emit)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range summary.Results {
+		if result.Err != nil {
+			summary.Failed++
+		} else {
+			summary.Succeeded++
+		}
+	}
+	summary.Elapsed = time.Since(start)
+	return summary
+}
+
+// process runs one item on the calling worker.
+func (b *Batch) process(ctx context.Context, index int, item BatchItem, emit func(BatchEvent)) BatchResult {
+	start := time.Now()
+	result := BatchResult{Item: item}
+	fail := func(err error) BatchResult {
+		result.Err = err
+		result.Elapsed = time.Since(start)
+		emit(BatchEvent{Type: EventFailed, Index: index, Item: item, Mismatch: result.Mismatch, Err: err})
+		return result
+	}
+
+	if err := ctx.Err(); err != nil {
+		return fail(fmt.Errorf("%s not processed: %w", item.name(), err))
+	}
+
+	// A file that cannot be read fails in ProcessLocalMediaFile instead
+	if ext, mismatch, err := ResolveFileExt(item.InputPath); err == nil {
+		result.Mismatch = mismatch
+		if _, supported := DefaultRegistry.Lookup(ext); !supported {
+			return fail(unsupportedError(ext, mismatch))
+		}
+	}
+	emit(BatchEvent{Type: EventStarted, Index: index, Item: item, Mismatch: result.Mismatch})
+
+	opts := b.Options
+	opts.Progress = func(percent float64) {
+		if b.Options.Progress != nil {
+			b.Options.Progress(percent)
+		}
+		emit(BatchEvent{Type: EventProgress, Index: index, Item: item, Percent: percent})
+	}
+	opts.TrackDropped = func(track DroppedTrack) {
+		if b.Options.TrackDropped != nil {
+			b.Options.TrackDropped(track)
+		}
+		result.Dropped = append(result.Dropped, track)
+	}
+
+	if err := ProcessLocalMediaFile(ctx, item.InputPath, item.OutputPath, opts); err != nil {
+		return fail(err)
+	}
+	result.Elapsed = time.Since(start)
+	emit(BatchEvent{Type: EventDone, Index: index, Item: item, Mismatch: result.Mismatch, Dropped: result.Dropped})
+	return result
+}
@@ -0,0 +1,93 @@
+package mediaprocessor
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// bmffBox locates a single ISO base media file format box (an "atom" in
+// QuickTime terms) within a file.
+type bmffBox struct {
+	typ string
+	// start is the offset of the box header and end is the offset just past
+	// the box. The body starts at start+headerLen.
+	start, end int64
+	headerLen  int64
+}
+
+func (b bmffBox) bodyStart() int64 { return b.start + b.headerLen }
+func (b bmffBox) size() int64      { return b.end - b.start }
+
+// readBoxes lists the boxes laid out back to back between start and end.
+func readBoxes(r io.ReaderAt, start, end int64) ([]bmffBox, error) {
+	var boxes []bmffBox
+	var header [16]byte
+	for pos := start; pos+8 <= end; {
+		if _, err := r.ReadAt(header[:8], pos); err != nil {
+			return nil, fmt.Errorf("error reading box header at offset %d: %w", pos, err)
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		box := bmffBox{typ: string(header[4:8]), start: pos, headerLen: 8}
+
+		switch size {
+		case 0:
+			// Box extends to the end of its container
+			size = end - pos
+		case 1:
+			if _, err := r.ReadAt(header[8:16], pos+8); err != nil {
+				return nil, fmt.Errorf("error reading box size at offset %d: %w", pos, err)
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+			box.headerLen = 16
+		}
+		if size < box.headerLen || pos+size > end {
+			return nil, fmt.Errorf("invalid %q box size at offset %d", box.typ, pos)
+		}
+
+		box.end = pos + size
+		boxes = append(boxes, box)
+		pos = box.end
+	}
+	return boxes, nil
+}
+
+// readBoxBody returns the body of b, skipping skip leading bytes such as the
+// version and flags of a full box.
+func readBoxBody(r io.ReaderAt, b bmffBox, skip int64) ([]byte, error) {
+	start := b.bodyStart() + skip
+	if start > b.end {
+		return nil, fmt.Errorf("%q box is too short", b.typ)
+	}
+	body := make([]byte, b.end-start)
+	if _, err := r.ReadAt(body, start); err != nil {
+		return nil, fmt.Errorf("error reading %q box: %w", b.typ, err)
+	}
+	return body, nil
+}
+
+// findBox returns the first box of the given type.
+func findBox(boxes []bmffBox, typ string) (bmffBox, bool) {
+	for _, b := range boxes {
+		if b.typ == typ {
+			return b, true
+		}
+	}
+	return bmffBox{}, false
+}
+
+// findPath descends from b through the first child of each type in path and
+// returns the box reached.
+func findPath(r io.ReaderAt, b bmffBox, path ...string) (bmffBox, bool) {
+	for _, typ := range path {
+		children, err := readBoxes(r, b.bodyStart(), b.end)
+		if err != nil {
+			return bmffBox{}, false
+		}
+		var found bool
+		if b, found = findBox(children, typ); !found {
+			return bmffBox{}, false
+		}
+	}
+	return b, true
+}
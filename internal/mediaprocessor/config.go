@@ -0,0 +1,55 @@
+package mediaprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Config holds settings read from a JSON configuration file, such as
+//
+//	{
+//	  "profile": "h264-small",
+//	  "profiles": [
+//	    {"name": "tiny", "video_codec": "libx264", "crf": 32, "max_dimension": 640, "audio_codec": "aac", "audio_bitrate": "64k"}
+//	  ],
+//	  "limits": {"max_pixels": 50000000, "max_input_bytes": 1073741824, "max_video_duration": "10:00"}
+//	}
+type Config struct {
+	// Profile names the transcoding profile used when none is requested.
+	Profile string `json:"profile,omitempty"`
+	// Profiles defines additional transcoding profiles.
+	Profiles []Profile `json:"profiles,omitempty"`
+	// Limits replaces the default resource limits. Nil keeps the defaults
+	// of the program reading the file.
+	Limits *Limits `json:"limits,omitempty"`
+}
+
+// LoadConfig reads the configuration file at path and registers the
+// profiles it defines.
+func LoadConfig(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("error reading config file: %w", err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	for _, p := range config.Profiles {
+		if err := RegisterProfile(p); err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	if _, err := ParseProfile(config.Profile); err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if config.Limits != nil {
+		if err := config.Limits.Validate(); err != nil {
+			return Config{}, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+	return config, nil
+}
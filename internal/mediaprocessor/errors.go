@@ -0,0 +1,105 @@
+package mediaprocessor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os/exec"
+)
+
+// The errors returned by this package wrap one of these, or are a
+// *TranscodeError, when the cause is worth telling apart. Use errors.Is and
+// errors.As to check, or ErrorCode to classify an error.
+var (
+	// ErrUnsupportedFormat means no processor handles the file's format.
+	ErrUnsupportedFormat = errors.New("unsupported file type")
+	// ErrDecodeFailed means the file could not be parsed or decoded as the
+	// format it was detected as, usually because it is corrupt.
+	ErrDecodeFailed = errors.New("cannot decode file")
+	// ErrTranscoderUnavailable means FFmpeg or FFprobe could not be run.
+	ErrTranscoderUnavailable = errors.New("transcoder unavailable")
+	// ErrLimitExceeded means the file exceeds one of the Limits.
+	ErrLimitExceeded = errors.New("limit exceeded")
+	// ErrInvalidRedaction means a redaction does not fit the file it is
+	// applied to, such as a region outside the picture.
+	ErrInvalidRedaction = errors.New("invalid redaction")
+)
+
+// TranscodeError reports that FFmpeg or FFprobe ran but failed, usually
+// because it could not make sense of the input.
+type TranscodeError struct {
+	// Command is the program that failed, "FFmpeg" or "FFprobe".
+	Command string
+	// Err is the error the program exited with.
+	Err error
+	// Stderr holds what the program wrote to its error output.
+	Stderr string
+}
+
+func (e *TranscodeError) Error() string {
+	return fmt.Sprintf("%s command failed: %v\n%s error output:\n%s", e.Command, e.Err, e.Command, e.Stderr)
+}
+
+func (e *TranscodeError) Unwrap() error {
+	return e.Err
+}
+
+// commandError describes err, returned by running command. A command that
+// did not exit with a status never started, so the transcoder is reported
+// unavailable.
+func commandError(command string, err error, stderr string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return fmt.Errorf("%w: %s could not be run: %w", ErrTranscoderUnavailable, command, err)
+	}
+	return &TranscodeError{Command: command, Err: err, Stderr: stderr}
+}
+
+// decodeError marks err, raised while parsing or decoding the input, as
+// ErrDecodeFailed.
+func decodeError(err error) error {
+	return fmt.Errorf("%w: %w", ErrDecodeFailed, err)
+}
+
+// ErrorCode classifies err for callers that report errors to machines:
+// "unsupported_format", "decode_failed", "transcode_failed",
+// "transcoder_unavailable", "limit_exceeded", "invalid_redaction", or
+// "internal" for anything else.
+func ErrorCode(err error) string {
+	var transcodeErr *TranscodeError
+	switch {
+	case errors.Is(err, ErrUnsupportedFormat):
+		return "unsupported_format"
+	case errors.Is(err, ErrDecodeFailed):
+		return "decode_failed"
+	case errors.Is(err, ErrTranscoderUnavailable):
+		return "transcoder_unavailable"
+	case errors.Is(err, ErrLimitExceeded):
+		return "limit_exceeded"
+	case errors.Is(err, ErrInvalidRedaction):
+		return "invalid_redaction"
+	case errors.As(err, &transcodeErr):
+		return "transcode_failed"
+	}
+	return "internal"
+}
+
+// statusByCode maps the codes of ErrorCode to HTTP statuses.
+var statusByCode = map[string]int{
+	"unsupported_format":     http.StatusUnsupportedMediaType,
+	"decode_failed":          http.StatusUnprocessableEntity,
+	"transcode_failed":       http.StatusUnprocessableEntity,
+	"invalid_redaction":      http.StatusUnprocessableEntity,
+	"limit_exceeded":         http.StatusRequestEntityTooLarge,
+	"transcoder_unavailable": http.StatusServiceUnavailable,
+	"internal":               http.StatusInternalServerError,
+}
+
+// HTTPStatus returns the HTTP status for a code of ErrorCode, or 500 for
+// any other code.
+func HTTPStatus(code string) int {
+	if status, ok := statusByCode[code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,350 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// TIFF field types and the size of a single value of each.
+var tiffTypeSizes = map[uint16]uint32{
+	1:  1, // BYTE
+	2:  1, // ASCII
+	3:  2, // SHORT
+	4:  4, // LONG
+	5:  8, // RATIONAL
+	6:  1, // SBYTE
+	7:  1, // UNDEFINED
+	8:  2, // SSHORT
+	9:  4, // SLONG
+	10: 8, // SRATIONAL
+	11: 4, // FLOAT
+	12: 8, // DOUBLE
+	13: 4, // IFD
+}
+
+const (
+	tiffTypeShort = 3
+	tiffTypeLong  = 4
+
+	tagOrientation = 0x0112
+	tagExifIFD     = 0x8769
+	tagGPSIFD      = 0x8825
+	tagInteropIFD  = 0xA005
+
+	maxIFDEntries = 1000
+)
+
+// exifIFD identifies which directory an entry was read from.
+type exifIFD int
+
+const (
+	ifd0 exifIFD = iota
+	ifdExif
+	ifdGPS
+)
+
+// exifEntry is a single TIFF directory entry. value holds the raw value
+// bytes in the byte order of the file they came from.
+type exifEntry struct {
+	ifd   exifIFD
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData is a parsed EXIF block. Only IFD0, the EXIF IFD and the GPS IFD
+// are kept; thumbnails (IFD1) and interoperability data are dropped.
+type exifData struct {
+	order   binary.ByteOrder
+	entries []exifEntry
+}
+
+var errNotTIFF = errors.New("not a TIFF header")
+
+// parseEXIF parses a TIFF-structured EXIF block, optionally prefixed with
+// the "Exif\0\0" identifier.
+func parseEXIF(data []byte) (*exifData, error) {
+	data = bytes.TrimPrefix(data, jpegExifID)
+	if len(data) < 8 {
+		return nil, errNotTIFF
+	}
+
+	e := &exifData{}
+	switch string(data[:4]) {
+	case "II*\x00":
+		e.order = binary.LittleEndian
+	case "MM\x00*":
+		e.order = binary.BigEndian
+	default:
+		return nil, errNotTIFF
+	}
+
+	seen := map[uint32]bool{}
+	var readIFD func(which exifIFD, offset uint32) error
+	readIFD = func(which exifIFD, offset uint32) error {
+		if seen[offset] {
+			return fmt.Errorf("EXIF directory loop at offset %d", offset)
+		}
+		seen[offset] = true
+
+		if uint64(offset)+2 > uint64(len(data)) {
+			return fmt.Errorf("EXIF directory offset %d out of range", offset)
+		}
+		n := uint32(e.order.Uint16(data[offset:]))
+		if n > maxIFDEntries || uint64(offset)+2+uint64(n)*12 > uint64(len(data)) {
+			return fmt.Errorf("invalid EXIF directory at offset %d", offset)
+		}
+
+		for i := uint32(0); i < n; i++ {
+			raw := data[offset+2+i*12:]
+			entry := exifEntry{
+				ifd:   which,
+				tag:   e.order.Uint16(raw[0:]),
+				typ:   e.order.Uint16(raw[2:]),
+				count: e.order.Uint32(raw[4:]),
+			}
+			size, known := tiffTypeSizes[entry.typ]
+			if !known {
+				continue
+			}
+			length := uint64(size) * uint64(entry.count)
+			if length <= 4 {
+				entry.value = append([]byte(nil), raw[8:8+length]...)
+			} else {
+				valueOffset := uint64(e.order.Uint32(raw[8:]))
+				if valueOffset+length > uint64(len(data)) {
+					continue // Skip values that point outside the block
+				}
+				entry.value = append([]byte(nil), data[valueOffset:valueOffset+length]...)
+			}
+
+			// A damaged sub-directory only loses its own entries
+			switch {
+			case which == ifd0 && entry.tag == tagExifIFD && len(entry.value) == 4:
+				readIFD(ifdExif, e.order.Uint32(entry.value))
+			case which == ifd0 && entry.tag == tagGPSIFD && len(entry.value) == 4:
+				readIFD(ifdGPS, e.order.Uint32(entry.value))
+			case entry.tag == tagInteropIFD:
+				// Interoperability data is never retained
+			default:
+				e.entries = append(e.entries, entry)
+			}
+		}
+		return nil
+	}
+
+	if err := readIFD(ifd0, e.order.Uint32(data[4:])); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// exifTagGroups assigns EXIF tags to the policy groups that govern them.
+// Tags not listed here are never retained.
+var exifTagGroups = map[exifIFD]map[uint16]TagGroup{
+	ifd0: {
+		0x0132: GroupCaptureDate, // DateTime
+		0x8298: GroupCopyright,   // Copyright
+		0x013B: GroupCopyright,   // Artist
+		0x010E: GroupDescription, // ImageDescription
+		0x010F: GroupCamera,      // Make
+		0x0110: GroupCamera,      // Model
+		0x0131: GroupSoftware,    // Software
+		0x000B: GroupSoftware,    // ProcessingSoftware
+		0xC62F: GroupSerial,      // CameraSerialNumber
+	},
+	ifdExif: {
+		0x9003: GroupCaptureDate, // DateTimeOriginal
+		0x9004: GroupCaptureDate, // DateTimeDigitized
+		0x9010: GroupCaptureDate, // OffsetTime
+		0x9011: GroupCaptureDate, // OffsetTimeOriginal
+		0x9012: GroupCaptureDate, // OffsetTimeDigitized
+		0x9290: GroupCaptureDate, // SubSecTime
+		0x9291: GroupCaptureDate, // SubSecTimeOriginal
+		0x9292: GroupCaptureDate, // SubSecTimeDigitized
+		0x9286: GroupDescription, // UserComment
+		0xA432: GroupCamera,      // LensSpecification
+		0xA433: GroupCamera,      // LensMake
+		0xA434: GroupCamera,      // LensModel
+		0x829A: GroupExposure,    // ExposureTime
+		0x829D: GroupExposure,    // FNumber
+		0x8822: GroupExposure,    // ExposureProgram
+		0x8827: GroupExposure,    // ISO
+		0x8830: GroupExposure,    // SensitivityType
+		0x8833: GroupExposure,    // ISOSpeed
+		0x9201: GroupExposure,    // ShutterSpeedValue
+		0x9202: GroupExposure,    // ApertureValue
+		0x9204: GroupExposure,    // ExposureBiasValue
+		0x9205: GroupExposure,    // MaxApertureValue
+		0x9207: GroupExposure,    // MeteringMode
+		0x9209: GroupExposure,    // Flash
+		0x920A: GroupExposure,    // FocalLength
+		0xA402: GroupExposure,    // ExposureMode
+		0xA403: GroupExposure,    // WhiteBalance
+		0xA405: GroupExposure,    // FocalLengthIn35mmFormat
+		0xA430: GroupOwner,       // CameraOwnerName
+		0xA431: GroupSerial,      // BodySerialNumber
+		0xA435: GroupSerial,      // LensSerialNumber
+		0xA420: GroupSerial,      // ImageUniqueID
+	},
+}
+
+// filter returns a copy of e holding only the entries the policy keeps.
+func (e *exifData) filter(policy Policy) *exifData {
+	kept := &exifData{order: e.order}
+	for _, entry := range e.entries {
+		group, known := exifTagGroups[entry.ifd][entry.tag]
+		if known && policy.Keeps(group) {
+			kept.entries = append(kept.entries, entry)
+		}
+	}
+	return kept
+}
+
+// encode serializes the entries as a TIFF block prefixed with "Exif\0\0",
+// ready to be placed in a JPEG APP1 segment.
+func (e *exifData) encode() []byte {
+	var main, sub []exifEntry
+	for _, entry := range e.entries {
+		switch entry.ifd {
+		case ifd0:
+			main = append(main, entry)
+		case ifdExif:
+			sub = append(sub, entry)
+		}
+	}
+	if len(sub) > 0 {
+		// The pointer's value is filled in once IFD0's size is known
+		main = append(main, exifEntry{ifd: ifd0, tag: tagExifIFD, typ: tiffTypeLong, count: 1, value: make([]byte, 4)})
+	}
+	sortEntries(main)
+	sortEntries(sub)
+
+	const ifd0Offset = 8
+	subOffset := ifd0Offset + ifdSize(main)
+	if len(sub) > 0 {
+		for i := range main {
+			if main[i].tag == tagExifIFD {
+				e.order.PutUint32(main[i].value, subOffset)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.Write(jpegExifID)
+	if e.order == binary.LittleEndian {
+		buf.WriteString("II*\x00")
+	} else {
+		buf.WriteString("MM\x00*")
+	}
+	binary.Write(&buf, e.order, uint32(ifd0Offset))
+	buf.Write(encodeIFD(e.order, main, ifd0Offset))
+	if len(sub) > 0 {
+		buf.Write(encodeIFD(e.order, sub, subOffset))
+	}
+	return buf.Bytes()
+}
+
+func sortEntries(entries []exifEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].tag < entries[j].tag })
+}
+
+// ifdSize returns the encoded size of a directory and its out-of-line values.
+func ifdSize(entries []exifEntry) uint32 {
+	size := uint32(2 + 12*len(entries) + 4)
+	for _, entry := range entries {
+		if n := uint32(len(entry.value)); n > 4 {
+			size += n + n%2
+		}
+	}
+	return size
+}
+
+// encodeIFD writes a single directory located at offset, followed by the
+// values that do not fit in their entries. The next-IFD link is zero.
+func encodeIFD(order binary.ByteOrder, entries []exifEntry, offset uint32) []byte {
+	var table, values bytes.Buffer
+	binary.Write(&table, order, uint16(len(entries)))
+
+	valueOffset := offset + uint32(2+12*len(entries)+4)
+	for _, entry := range entries {
+		binary.Write(&table, order, entry.tag)
+		binary.Write(&table, order, entry.typ)
+		binary.Write(&table, order, entry.count)
+		if len(entry.value) <= 4 {
+			var inline [4]byte
+			copy(inline[:], entry.value)
+			table.Write(inline[:])
+			continue
+		}
+		binary.Write(&table, order, valueOffset+uint32(values.Len()))
+		values.Write(entry.value)
+		if values.Len()%2 == 1 {
+			values.WriteByte(0)
+		}
+	}
+	binary.Write(&table, order, uint32(0))
+
+	return append(table.Bytes(), values.Bytes()...)
+}
+
+// extractEXIF returns the raw EXIF block embedded in a JPEG, PNG or HEIF
+// image, or nil if there is none.
+func extractEXIF(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, markerSOI}):
+		segments, _, err := scanJPEG(data)
+		if err != nil {
+			return nil
+		}
+		for _, s := range segments {
+			if s.marker == markerAPP1 && s.hasPrefix(jpegExifID) {
+				return s.payload
+			}
+		}
+	case bytes.HasPrefix(data, pngSignature):
+		chunks, err := scanPNG(data)
+		if err != nil {
+			return nil
+		}
+		for _, c := range chunks {
+			if c.typ == "eXIf" {
+				return c.data
+			}
+		}
+	default:
+		return extractHEIFEXIF(bytes.NewReader(data))
+	}
+	return nil
+}
+
+// orientation returns the value of the IFD0 Orientation tag, or 1 if it is
+// missing or invalid.
+func (e *exifData) orientation() int {
+	for _, entry := range e.entries {
+		if entry.ifd == ifd0 && entry.tag == tagOrientation && entry.typ == tiffTypeShort && len(entry.value) >= 2 {
+			if o := int(e.order.Uint16(entry.value)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+	}
+	return 1
+}
+
+// setOrientation adds or replaces the IFD0 Orientation tag.
+func (e *exifData) setOrientation(orientation int) {
+	value := make([]byte, 2)
+	e.order.PutUint16(value, uint16(orientation))
+	entry := exifEntry{ifd: ifd0, tag: tagOrientation, typ: tiffTypeShort, count: 1, value: value}
+	for i := range e.entries {
+		if e.entries[i].ifd == ifd0 && e.entries[i].tag == tagOrientation {
+			e.entries[i] = entry
+			return
+		}
+	}
+	e.entries = append(e.entries, entry)
+}
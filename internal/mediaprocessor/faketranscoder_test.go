@@ -0,0 +1,118 @@
+package mediaprocessor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+)
+
+// fakeProbeJSON describes a ten second 1920x1080 H.264 video with AAC audio.
+const fakeProbeJSON = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "width": 1920, "height": 1080, "duration": "10.000000"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "duration": "10.000000"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "10.000000"}
+}`
+
+// fakeTranscoder is an in-process Transcoder for testing the video code
+// paths without FFmpeg. It probes every file as the same video and
+// "transcodes" by copying the input to the output unchanged. It records the
+// arguments of every Transcode call and is safe for concurrent use.
+type fakeTranscoder struct {
+	// ProbeJSON is the ffprobe report returned for every file. Nil uses a
+	// ten second 1920x1080 H.264 video with AAC audio.
+	ProbeJSON []byte
+	// Encoders lists the encoders reported. Nil reports libx264, libx265
+	// and aac.
+	Encoders []string
+	// Err, if set, is returned by every method.
+	Err error
+
+	mu    sync.Mutex
+	calls [][]string
+}
+
+// Probe implements Transcoder.
+func (f *fakeTranscoder) Probe(ctx context.Context, path string) ([]byte, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, &TranscodeError{Command: "FFprobe", Err: err, Stderr: err.Error()}
+	}
+	if f.ProbeJSON != nil {
+		return f.ProbeJSON, nil
+	}
+	return []byte(fakeProbeJSON), nil
+}
+
+// Transcode implements Transcoder. The input follows -i and the output is
+// the last argument, as in the commands this package builds.
+func (f *fakeTranscoder) Transcode(ctx context.Context, args []string, progress io.Writer) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, slices.Clone(args))
+	f.mu.Unlock()
+
+	if f.Err != nil {
+		return f.Err
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("FFmpeg command cancelled: %w", err)
+	}
+
+	i := slices.Index(args, "-i")
+	if i < 0 || i+1 >= len(args)-1 {
+		return &TranscodeError{Command: "FFmpeg", Err: fmt.Errorf("exit status 1"), Stderr: "no input or output file"}
+	}
+	if err := copyFile(args[i+1], args[len(args)-1]); err != nil {
+		return &TranscodeError{Command: "FFmpeg", Err: fmt.Errorf("exit status 1"), Stderr: err.Error()}
+	}
+
+	if progress != nil {
+		io.WriteString(progress, "out_time_us=10000000\nprogress=end\n")
+	}
+	return nil
+}
+
+// Capabilities implements Transcoder.
+func (f *fakeTranscoder) Capabilities(ctx context.Context) (*Capabilities, error) {
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	encoders := f.Encoders
+	if encoders == nil {
+		encoders = []string{"aac", "libx264", "libx265"}
+	}
+	encoders = slices.Clone(encoders)
+	slices.Sort(encoders)
+	return &Capabilities{Version: "fake", Encoders: encoders}, nil
+}
+
+// Calls returns the arguments of each Transcode call so far, in order.
+func (f *fakeTranscoder) Calls() [][]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.calls)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
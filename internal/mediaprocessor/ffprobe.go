@@ -0,0 +1,77 @@
+package mediaprocessor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// probeResult is the subset of `ffprobe -print_format json` output we use.
+type probeResult struct {
+	Streams  []probeStream `json:"streams"`
+	Format   probeFormat   `json:"format"`
+	Chapters []struct {
+		ID   int64             `json:"id"`
+		Tags map[string]string `json:"tags"`
+	} `json:"chapters"`
+}
+
+type probeStream struct {
+	Index          int               `json:"index"`
+	CodecType      string            `json:"codec_type"`
+	CodecName      string            `json:"codec_name"`
+	CodecTagString string            `json:"codec_tag_string"`
+	Width          int               `json:"width"`
+	Height         int               `json:"height"`
+	Duration       string            `json:"duration"`
+	Disposition    map[string]int    `json:"disposition"`
+	Tags           map[string]string `json:"tags"`
+	SideDataList   []struct {
+		Rotation int `json:"rotation"`
+	} `json:"side_data_list"`
+}
+
+// displaySize returns the size of the stream's frames once FFmpeg has
+// applied the rotation from the display matrix or the legacy rotate tag.
+func (s probeStream) displaySize() (width, height int) {
+	rotation, _ := strconv.Atoi(s.Tags["rotate"])
+	for _, side := range s.SideDataList {
+		if side.Rotation != 0 {
+			rotation = side.Rotation
+		}
+	}
+	if rotation%180 != 0 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+type probeFormat struct {
+	FormatName string            `json:"format_name"`
+	Duration   string            `json:"duration"`
+	Tags       map[string]string `json:"tags"`
+}
+
+// duration returns the container duration in seconds, or 0 if unknown.
+func (p *probeResult) duration() float64 {
+	d, err := strconv.ParseFloat(p.Format.Duration, 64)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// probe runs the transcoder's ffprobe on the file at path.
+func probe(ctx context.Context, t Transcoder, path string) (*probeResult, error) {
+	out, err := t.Probe(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result probeResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, fmt.Errorf("error parsing FFprobe output: %w", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,164 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// minPlainCorrelation is the least noise residual correlation a plain JPEG
+// re-encode keeps, which shows the measurement finds a fingerprint that is
+// there.
+const minPlainCorrelation = 0.7
+
+// maxMitigatedCorrelation is the most correlation the fingerprint
+// mitigation may leave at each strength. The mitigation is random, so the
+// median of several runs is compared.
+var maxMitigatedCorrelation = map[float64]float64{
+	0.25: 0.6,
+	0.5:  0.45,
+	1:    0.15,
+}
+
+// noiseResidualCorrelation measures how much of the sensor noise of original
+// survives in processed, as the normalized cross-correlation of their noise
+// residuals: each image's luminance minus a 3x3 mean-filtered copy of it.
+// processed is first resized to the size of original, so resampling alone
+// does not hide the pattern, but crops are not searched for. A value near 1
+// means the fingerprint is intact and near 0 that it no longer matches. It is
+// a per-image proxy for the camera fingerprint matching done with many
+// photos, meant for comparing mitigation settings.
+func noiseResidualCorrelation(original, processed image.Image) float64 {
+	bounds := original.Bounds()
+	resized := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.BiLinear.Scale(resized, resized.Bounds(), processed, processed.Bounds(), draw.Src, nil)
+
+	a := noiseResidual(original)
+	b := noiseResidual(resized)
+
+	var meanA, meanB float64
+	for i := range a {
+		meanA += a[i]
+		meanB += b[i]
+	}
+	meanA /= float64(len(a))
+	meanB /= float64(len(b))
+
+	var cross, varA, varB float64
+	for i := range a {
+		da, db := a[i]-meanA, b[i]-meanB
+		cross += da * db
+		varA += da * da
+		varB += db * db
+	}
+	if varA == 0 || varB == 0 {
+		return 0
+	}
+	return cross / math.Sqrt(varA*varB)
+}
+
+// noiseResidual returns the luminance of img minus its 3x3 local mean, row
+// by row.
+func noiseResidual(img image.Image) []float64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	luma := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luma[y*w+x] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+		}
+	}
+
+	residual := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var sum float64
+			var n int
+			for ny := max(y-1, 0); ny <= min(y+1, h-1); ny++ {
+				for nx := max(x-1, 0); nx <= min(x+1, w-1); nx++ {
+					sum += luma[ny*w+nx]
+					n++
+				}
+			}
+			residual[y*w+x] = luma[y*w+x] - sum/float64(n)
+		}
+	}
+	return residual
+}
+
+// testPhoto returns a JPEG of a smooth gradient overlaid with a fixed
+// per-pixel gain pattern, standing in for the sensor noise of a camera.
+func testPhoto(t testing.TB, w, h int) []byte {
+	t.Helper()
+	prnu := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			gain := 1 + 0.05*prnu.NormFloat64()
+			i := img.PixOffset(x, y)
+			img.Pix[i+0] = uint8(min(max(float64(60+x*120/w)*gain, 0), 255))
+			img.Pix[i+1] = uint8(min(max(float64(80+y*120/h)*gain, 0), 255))
+			img.Pix[i+2] = uint8(min(max(float64(100+(x+y)*50/(w+h))*gain, 0), 255))
+			img.Pix[i+3] = 0xff
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// scrubPhoto processes data as a JPEG with the given mitigation strength
+// and decodes the output.
+func scrubPhoto(t testing.TB, data []byte, strength float64) image.Image {
+	t.Helper()
+	var out bytes.Buffer
+	opts := Options{AntiFingerprint: strength, SkipVerify: true}
+	if err := Process(context.Background(), bytes.NewReader(data), &out, ".jpg", opts); err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// TestAntiFingerprint compares the noise residual of a scrubbed photo with
+// that of its output at each mitigation strength and of a plain re-encode.
+func TestAntiFingerprint(t *testing.T) {
+	data := testPhoto(t, 256, 256)
+	reference := scrubPhoto(t, data, 0)
+
+	var reencoded bytes.Buffer
+	if err := jpeg.Encode(&reencoded, reference, &jpeg.Options{Quality: DefaultJPEGQuality}); err != nil {
+		t.Fatal(err)
+	}
+	plain, err := jpeg.Decode(&reencoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := noiseResidualCorrelation(reference, plain); c < minPlainCorrelation {
+		t.Fatalf("plain re-encode correlation = %.3f, want at least %g", c, minPlainCorrelation)
+	}
+
+	for strength, limit := range maxMitigatedCorrelation {
+		var correlations []float64
+		for i := 0; i < 5; i++ {
+			correlations = append(correlations, noiseResidualCorrelation(reference, scrubPhoto(t, data, strength)))
+		}
+		sort.Float64s(correlations)
+		if c := correlations[2]; c > limit {
+			t.Errorf("strength %g: median correlation = %.3f, want at most %g", strength, c, limit)
+		}
+	}
+}
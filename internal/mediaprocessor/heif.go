@@ -0,0 +1,143 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/adrium/goheif/heif"
+)
+
+// heifMetaBoxes returns the children of the top-level "meta" box of a
+// HEIF/AVIF file, or nil if it has none.
+func heifMetaBoxes(r io.ReaderAt, size int64) ([]bmffBox, error) {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HEIF boxes: %w", err)
+	}
+	meta, ok := findBox(top, "meta")
+	if !ok {
+		return nil, nil
+	}
+	// meta is a full box: skip version and flags
+	children, err := readBoxes(r, meta.bodyStart()+4, meta.end)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HEIF meta box: %w", err)
+	}
+	return children, nil
+}
+
+// heifPropertyBoxes returns the item properties stored in iprp/ipco.
+func heifPropertyBoxes(r io.ReaderAt, meta []bmffBox) ([]bmffBox, error) {
+	iprp, ok := findBox(meta, "iprp")
+	if !ok {
+		return nil, nil
+	}
+	props, err := readBoxes(r, iprp.bodyStart(), iprp.end)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HEIF item properties: %w", err)
+	}
+	ipco, ok := findBox(props, "ipco")
+	if !ok {
+		return nil, nil
+	}
+	boxes, err := readBoxes(r, ipco.bodyStart(), ipco.end)
+	if err != nil {
+		return nil, fmt.Errorf("error reading HEIF property container: %w", err)
+	}
+	return boxes, nil
+}
+
+// heifICCProfile returns the body of a "colr" property if it carries an ICC
+// profile.
+func heifICCProfile(r io.ReaderAt, colr bmffBox) ([]byte, error) {
+	body, err := readBoxBody(r, colr, 0)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(body, []byte("prof")) || bytes.HasPrefix(body, []byte("rICC")) {
+		return body[4:], nil
+	}
+	return nil, nil
+}
+
+// heifItemInfo is the part of an "infe" box that identifies an item.
+type heifItemInfo struct {
+	itemType    string
+	contentType string
+}
+
+func readHEIFItemInfos(r io.ReaderAt, iinf bmffBox) ([]heifItemInfo, error) {
+	body, err := readBoxBody(r, iinf, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Full box header followed by a 16 or 32 bit entry count
+	countLen := int64(2)
+	if len(body) > 0 && body[0] != 0 {
+		countLen = 4
+	}
+	entries, err := readBoxes(bytes.NewReader(body), 4+countLen, int64(len(body)))
+	if err != nil {
+		return nil, fmt.Errorf("error reading HEIF item info: %w", err)
+	}
+
+	var items []heifItemInfo
+	for _, entry := range entries {
+		if entry.typ != "infe" {
+			continue
+		}
+		infe := body[entry.bodyStart():entry.end]
+		if len(infe) < 4 || infe[0] < 2 {
+			continue // Versions 0 and 1 carry no item type
+		}
+		// Skip version/flags, item ID and protection index
+		pos := 4 + 2 + 2
+		if infe[0] == 3 {
+			pos += 2
+		}
+		if pos+4 > len(infe) {
+			continue
+		}
+		item := heifItemInfo{itemType: string(infe[pos : pos+4])}
+		rest := infe[pos+4:]
+		_, rest, _ = bytes.Cut(rest, []byte{0}) // item_name
+		if item.itemType == "mime" {
+			contentType, _, _ := bytes.Cut(rest, []byte{0})
+			item.contentType = string(contentType)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// extractHEIFEXIF returns the EXIF item of a HEIF file, or nil.
+func extractHEIFEXIF(r io.ReaderAt) []byte {
+	data, err := heif.Open(r).EXIF()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// extractHEIFICC returns the first ICC profile among the item properties of a
+// HEIF file, or nil.
+func extractHEIFICC(r io.ReaderAt, size int64) []byte {
+	meta, err := heifMetaBoxes(r, size)
+	if err != nil {
+		return nil
+	}
+	props, err := heifPropertyBoxes(r, meta)
+	if err != nil {
+		return nil
+	}
+	for _, b := range props {
+		if b.typ != "colr" {
+			continue
+		}
+		if profile, err := heifICCProfile(r, b); err == nil && profile != nil {
+			return profile
+		}
+	}
+	return nil
+}
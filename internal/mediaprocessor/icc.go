@@ -0,0 +1,91 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"compress/zlib"
+	"io"
+	"sort"
+)
+
+// maxICCChunk is the largest profile slice that fits in one APP2 segment
+// after the identifier and sequence bytes.
+const maxICCChunk = 0xFFFF - 2 - 14
+
+// extractICC returns the ICC profile embedded in a JPEG, PNG or HEIF image,
+// or nil if there is none.
+func extractICC(data []byte) []byte {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, markerSOI}):
+		segments, _, err := scanJPEG(data)
+		if err != nil {
+			return nil
+		}
+		// Profiles larger than one segment are split into numbered chunks
+		type chunk struct {
+			seq  byte
+			data []byte
+		}
+		var chunks []chunk
+		for _, s := range segments {
+			if s.marker == markerAPP2 && s.hasPrefix(jpegICCID) && len(s.payload) >= 14 {
+				chunks = append(chunks, chunk{seq: s.payload[12], data: s.payload[14:]})
+			}
+		}
+		if len(chunks) == 0 {
+			return nil
+		}
+		sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].seq < chunks[j].seq })
+		var profile []byte
+		for _, c := range chunks {
+			profile = append(profile, c.data...)
+		}
+		return profile
+	case bytes.HasPrefix(data, pngSignature):
+		chunks, err := scanPNG(data)
+		if err != nil {
+			return nil
+		}
+		for _, c := range chunks {
+			if c.typ != "iCCP" {
+				continue
+			}
+			// Profile name, compression method, then zlib data
+			_, rest, found := bytes.Cut(c.data, []byte{0})
+			if !found || len(rest) < 1 {
+				return nil
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(rest[1:]))
+			if err != nil {
+				return nil
+			}
+			profile, err := io.ReadAll(io.LimitReader(zr, 16<<20))
+			if err != nil {
+				return nil
+			}
+			return profile
+		}
+	default:
+		return extractHEIFICC(bytes.NewReader(data), int64(len(data)))
+	}
+	return nil
+}
+
+// iccSegments splits an ICC profile into APP2 segment payloads.
+func iccSegments(profile []byte) [][]byte {
+	count := (len(profile) + maxICCChunk - 1) / maxICCChunk
+	if count == 0 || count > 255 {
+		return nil
+	}
+	payloads := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * maxICCChunk
+		if end > len(profile) {
+			end = len(profile)
+		}
+		payload := append([]byte(nil), jpegICCID...)
+		payload = append(payload, byte(i+1), byte(count))
+		payload = append(payload, profile[i*maxICCChunk:end]...)
+		payloads = append(payloads, payload)
+	}
+	return payloads
+}
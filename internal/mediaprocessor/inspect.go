@@ -0,0 +1,433 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evanoberholster/imagemeta"
+	"github.com/evanoberholster/imagemeta/exif2"
+	"github.com/evanoberholster/imagemeta/imagetype"
+)
+
+// Inspector is implemented by processors that can report the metadata a
+// file carries without modifying it.
+type Inspector interface {
+	Inspect(ctx context.Context, r io.Reader) (*Report, error)
+}
+
+// Report describes the metadata found in a media file.
+type Report struct {
+	// Format is the detected MIME type of the file.
+	Format string       `json:"format"`
+	Image  *ImageReport `json:"image,omitempty"`
+	Video  *VideoReport `json:"video,omitempty"`
+}
+
+// ImageReport lists the metadata blocks found in an image.
+type ImageReport struct {
+	Width       int               `json:"width,omitempty"`
+	Height      int               `json:"height,omitempty"`
+	Orientation int               `json:"orientation,omitempty"`
+	EXIF        bool              `json:"exif"`
+	EXIFTags    map[string]string `json:"exif_tags,omitempty"`
+	GPS         *GPSReport        `json:"gps,omitempty"`
+	Camera      *CameraReport     `json:"camera,omitempty"`
+	XMP         bool              `json:"xmp"`
+	IPTC        bool              `json:"iptc"`
+	ICCProfile  bool              `json:"icc_profile"`
+	Thumbnails  int               `json:"thumbnails"`
+	// Other names any further metadata blocks, such as comments, text
+	// chunks or data trailing the image.
+	Other []string `json:"other,omitempty"`
+}
+
+// GPSReport holds the location recorded in an image's EXIF data.
+type GPSReport struct {
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Altitude  float32    `json:"altitude,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+}
+
+// CameraReport identifies the device that captured an image.
+type CameraReport struct {
+	Make       string `json:"make,omitempty"`
+	Model      string `json:"model,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	LensMake   string `json:"lens_make,omitempty"`
+	LensModel  string `json:"lens_model,omitempty"`
+	LensSerial string `json:"lens_serial,omitempty"`
+	OwnerName  string `json:"owner_name,omitempty"`
+}
+
+// VideoReport lists the metadata found in a video container.
+type VideoReport struct {
+	Container string            `json:"container"`
+	Duration  float64           `json:"duration"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	// Location is the ISO 6709 location tag, if the container has one.
+	Location string         `json:"location,omitempty"`
+	Streams  []StreamReport `json:"streams"`
+	// DataTracks are streams that are neither audio nor video, such as
+	// timecode, timed metadata, telemetry or subtitles.
+	DataTracks []StreamReport `json:"data_tracks,omitempty"`
+	Chapters   int            `json:"chapters,omitempty"`
+}
+
+// StreamReport describes a single stream of a video container.
+type StreamReport struct {
+	Index    int               `json:"index"`
+	Type     string            `json:"type"`
+	Codec    string            `json:"codec,omitempty"`
+	CodecTag string            `json:"codec_tag,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// Inspect reports the metadata in the media read from r using the processor
+// registered in DefaultRegistry for its format, detected as in Process.
+func Inspect(ctx context.Context, r io.Reader, ext string) (*Report, error) {
+	ext, mismatch, r, err := sniff(r, ext)
+	if err != nil {
+		return nil, err
+	}
+	processor, supported := DefaultRegistry.Lookup(ext)
+	if !supported {
+		return nil, unsupportedError(ext, mismatch)
+	}
+	inspector, ok := processor.(Inspector)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s cannot be inspected", ErrUnsupportedFormat, ext)
+	}
+	return inspector.Inspect(ctx, r)
+}
+
+// InspectFile reports the metadata in the file at path.
+func InspectFile(ctx context.Context, path string) (*Report, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %w", err)
+	}
+	defer f.Close()
+
+	return Inspect(ctx, f, filepath.Ext(path))
+}
+
+// Inspect implements Inspector.
+func (ImageProcessor) Inspect(ctx context.Context, r io.Reader) (*Report, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading input: %w", err)
+	}
+	return inspectImage(data)
+}
+
+func inspectImage(data []byte) (*Report, error) {
+	it, err := imagetype.Buf(data)
+	if err != nil {
+		return nil, decodeError(fmt.Errorf("error detecting image type: %w", err))
+	}
+
+	report := &ImageReport{}
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		report.Width, report.Height = cfg.Width, cfg.Height
+	}
+
+	metadata, err := imagemeta.Decode(bytes.NewReader(data))
+	if err == nil {
+		addEXIFDetails(report, metadata)
+	}
+
+	switch it {
+	case imagetype.ImageJPEG:
+		err = inspectJPEGSegments(report, data)
+	case imagetype.ImagePNG:
+		err = inspectPNGChunks(report, data)
+	case imagetype.ImageHEIF, imagetype.ImageAVIF:
+		err = inspectHEIFBoxes(report, bytes.NewReader(data), int64(len(data)))
+	}
+	if err != nil {
+		return nil, decodeError(err)
+	}
+
+	return &Report{Format: it.String(), Image: report}, nil
+}
+
+// addEXIFDetails copies the identifying fields of a decoded EXIF block into
+// the report.
+func addEXIFDetails(report *ImageReport, e exif2.Exif) {
+	if e.Orientation > 0 && e.Orientation <= 8 {
+		report.Orientation = int(e.Orientation)
+	}
+
+	tags := map[string]string{}
+	addTag := func(name, value string) {
+		if value = strings.TrimSpace(value); value != "" {
+			tags[name] = value
+		}
+	}
+	addTime := func(name string, t time.Time) {
+		if !t.IsZero() {
+			tags[name] = t.Format(time.RFC3339)
+		}
+	}
+	addTime("DateTimeOriginal", e.DateTimeOriginal())
+	addTime("CreateDate", e.CreateDate())
+	addTime("ModifyDate", e.ModifyDate())
+	addTag("Software", e.Software)
+	addTag("ProcessingSoftware", e.ProcessingSoftware)
+	addTag("Artist", e.Artist)
+	addTag("Copyright", e.Copyright)
+	addTag("ImageDescription", e.ImageDescription)
+	addTag("DocumentName", e.DocumentName)
+	addTag("ImageUniqueID", e.ImageUniqueID)
+	if e.ExposureTime != 0 {
+		addTag("ExposureTime", e.ExposureTime.String())
+	}
+	if e.FNumber != 0 {
+		addTag("FNumber", e.FNumber.String())
+	}
+	if e.FocalLength != 0 {
+		addTag("FocalLength", e.FocalLength.String())
+	}
+	if e.ISOSpeed != 0 {
+		addTag("ISO", fmt.Sprint(e.ISOSpeed))
+	} else if e.ISO != 0 {
+		addTag("ISO", fmt.Sprint(e.ISO))
+	}
+	if len(tags) > 0 {
+		report.EXIFTags = tags
+	}
+
+	if lat, lng := e.GPS.Latitude(), e.GPS.Longitude(); lat != 0 || lng != 0 {
+		report.GPS = &GPSReport{Latitude: lat, Longitude: lng, Altitude: e.GPS.Altitude()}
+		if t := e.GPS.Date(); !t.IsZero() {
+			report.GPS.Time = &t
+		}
+	}
+
+	camera := CameraReport{
+		Make:       strings.TrimSpace(e.Make),
+		Model:      strings.TrimSpace(e.Model),
+		Serial:     strings.TrimSpace(e.CameraSerial),
+		LensMake:   strings.TrimSpace(e.LensMake),
+		LensModel:  strings.TrimSpace(e.LensModel),
+		LensSerial: strings.TrimSpace(e.LensSerial),
+		OwnerName:  strings.TrimSpace(e.OwnerName),
+	}
+	if camera != (CameraReport{}) {
+		report.Camera = &camera
+	}
+
+	if e.ThumbnailLength > 0 {
+		report.Thumbnails++
+	}
+}
+
+func inspectJPEGSegments(report *ImageReport, data []byte) error {
+	segments, trailer, err := scanJPEG(data)
+	if err != nil {
+		return fmt.Errorf("error reading JPEG segments: %w", err)
+	}
+
+	for _, s := range segments {
+		switch {
+		case s.marker == markerAPP1 && s.hasPrefix(jpegExifID):
+			report.EXIF = true
+		case s.marker == markerAPP1 && (s.hasPrefix(jpegXMPID) || s.hasPrefix(jpegXMPExtID)):
+			report.XMP = true
+		case s.marker == markerAPP13 && s.hasPrefix(jpegPhotoshopID):
+			report.IPTC = true
+		case s.marker == markerAPP2 && s.hasPrefix(jpegICCID):
+			report.ICCProfile = true
+		case s.marker == markerAPP2 && s.hasPrefix(jpegMPFID):
+			report.Other = appendOnce(report.Other, "MPF")
+		case s.marker == markerAPP2 && s.hasPrefix(jpegFlashPixID):
+			report.Other = appendOnce(report.Other, "FlashPix")
+		case s.marker == markerAPP11:
+			report.Other = appendOnce(report.Other, "JUMBF")
+		case s.marker == markerCOM:
+			report.Other = appendOnce(report.Other, "comment")
+		case s.marker > markerAPP0 && s.marker <= 0xEF && s.marker != markerAPP14:
+			report.Other = appendOnce(report.Other, fmt.Sprintf("APP%d", s.marker-markerAPP0))
+		}
+	}
+
+	if len(trailer) > 0 {
+		report.Other = append(report.Other, fmt.Sprintf("trailing data (%d bytes)", len(trailer)))
+	}
+	return nil
+}
+
+// pngRenderingChunks are the ancillary PNG chunks that affect how pixels are
+// displayed rather than describing the image.
+var pngRenderingChunks = map[string]bool{
+	"tRNS": true,
+	"gAMA": true,
+	"cHRM": true,
+	"sRGB": true,
+	"cICP": true,
+	"bKGD": true,
+	"sBIT": true,
+	"hIST": true,
+	"sPLT": true,
+	"acTL": true,
+	"fcTL": true,
+	"fdAT": true,
+}
+
+func inspectPNGChunks(report *ImageReport, data []byte) error {
+	chunks, err := scanPNG(data)
+	if err != nil {
+		return fmt.Errorf("error reading PNG chunks: %w", err)
+	}
+
+	for _, c := range chunks {
+		switch c.typ {
+		case "eXIf":
+			report.EXIF = true
+		case "iCCP":
+			report.ICCProfile = true
+		case "tEXt", "zTXt", "iTXt":
+			keyword, _, _ := bytes.Cut(c.data, []byte{0})
+			switch string(keyword) {
+			case "XML:com.adobe.xmp", "Raw profile type xmp":
+				report.XMP = true
+			case "Raw profile type exif", "Raw profile type APP1":
+				report.EXIF = true
+			case "Raw profile type iptc", "Raw profile type 8bim":
+				report.IPTC = true
+			default:
+				report.Other = appendOnce(report.Other, fmt.Sprintf("%s %s", c.typ, keyword))
+			}
+		default:
+			if !c.critical() && !pngRenderingChunks[c.typ] {
+				report.Other = appendOnce(report.Other, c.typ)
+			}
+		}
+	}
+	return nil
+}
+
+// inspectHEIFBoxes walks the item boxes of a HEIF/AVIF file looking for
+// EXIF and XMP items, colour profiles and thumbnail references.
+func inspectHEIFBoxes(report *ImageReport, r io.ReaderAt, size int64) error {
+	meta, err := heifMetaBoxes(r, size)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range meta {
+		switch child.typ {
+		case "iinf":
+			items, err := readHEIFItemInfos(r, child)
+			if err != nil {
+				return err
+			}
+			for _, item := range items {
+				switch {
+				case item.itemType == "Exif":
+					report.EXIF = true
+				case item.itemType == "mime" && item.contentType == "application/rdf+xml":
+					report.XMP = true
+				case item.itemType == "mime":
+					report.Other = appendOnce(report.Other, item.contentType)
+				}
+			}
+		case "iref":
+			body, err := readBoxBody(r, child, 0)
+			if err != nil {
+				return err
+			}
+			refs, err := readBoxes(bytes.NewReader(body), 4, int64(len(body)))
+			if err != nil {
+				return fmt.Errorf("error reading HEIF item references: %w", err)
+			}
+			for _, ref := range refs {
+				if ref.typ == "thmb" {
+					report.Thumbnails++
+				}
+			}
+		}
+	}
+
+	props, err := heifPropertyBoxes(r, meta)
+	if err != nil {
+		return err
+	}
+	for _, b := range props {
+		if b.typ != "colr" {
+			continue
+		}
+		profile, err := heifICCProfile(r, b)
+		if err != nil {
+			return err
+		}
+		if profile != nil {
+			report.ICCProfile = true
+		}
+	}
+	return nil
+}
+
+func appendOnce(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+	return append(list, value)
+}
+
+// Inspect implements Inspector using the transcoder's FFprobe.
+func (p VideoProcessor) Inspect(ctx context.Context, r io.Reader) (*Report, error) {
+	inputPath, cleanup, err := spoolToFile(r, DefaultScratch.NewJob())
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	probed, err := probe(ctx, p.transcoder(), inputPath)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VideoReport{
+		Container: probed.Format.FormatName,
+		Duration:  probed.duration(),
+		Tags:      probed.Format.Tags,
+		Streams:   []StreamReport{},
+		Chapters:  len(probed.Chapters),
+	}
+	for key, value := range probed.Format.Tags {
+		if strings.Contains(strings.ToLower(key), "location") {
+			report.Location = value
+		}
+	}
+	for _, s := range probed.Streams {
+		stream := StreamReport{
+			Index:    s.Index,
+			Type:     s.CodecType,
+			Codec:    s.CodecName,
+			CodecTag: s.CodecTagString,
+			Tags:     s.Tags,
+		}
+		if s.CodecType == "audio" || s.CodecType == "video" {
+			report.Streams = append(report.Streams, stream)
+		} else {
+			report.DataTracks = append(report.DataTracks, stream)
+		}
+	}
+
+	format := "video/mp4"
+	if probed.Format.Tags["major_brand"] == "qt  " {
+		format = "video/quicktime"
+	}
+	return &Report{Format: format, Video: report}, nil
+}
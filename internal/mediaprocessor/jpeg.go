@@ -0,0 +1,257 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// JPEG marker codes used when walking segments.
+const (
+	markerSOI   = 0xD8
+	markerEOI   = 0xD9
+	markerSOS   = 0xDA
+	markerAPP0  = 0xE0
+	markerAPP1  = 0xE1
+	markerAPP2  = 0xE2
+	markerAPP11 = 0xEB
+	markerAPP13 = 0xED
+	markerAPP14 = 0xEE
+	markerCOM   = 0xFE
+)
+
+// Identifiers found at the start of APPn payloads.
+var (
+	jpegExifID      = []byte("Exif\x00\x00")
+	jpegXMPID       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	jpegXMPExtID    = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	jpegICCID       = []byte("ICC_PROFILE\x00")
+	jpegPhotoshopID = []byte("Photoshop 3.0\x00")
+	jpegMPFID       = []byte("MPF\x00")
+	jpegFlashPixID  = []byte("FPXR\x00")
+)
+
+var errNotJPEG = errors.New("not a JPEG file")
+
+// jpegSegment is a single marker segment of a JPEG file.
+type jpegSegment struct {
+	marker byte
+	// payload is the segment body after the length field.
+	payload []byte
+	// raw is the segment exactly as it appeared in the file, including the
+	// marker. For SOS it also covers the entropy-coded data that follows.
+	raw []byte
+}
+
+// scanJPEG splits data into its marker segments, from SOI up to and
+// including EOI. Anything after EOI, such as appended MPF images or vendor
+// trailers, is returned separately.
+func scanJPEG(data []byte) (segments []jpegSegment, trailer []byte, err error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, nil, errNotJPEG
+	}
+	segments = append(segments, jpegSegment{marker: markerSOI, raw: data[:2]})
+
+	pos := 2
+	for pos < len(data) {
+		if data[pos] != 0xFF {
+			return nil, nil, fmt.Errorf("expected JPEG marker at offset %d", pos)
+		}
+		// Skip fill bytes
+		start := pos
+		for pos < len(data) && data[pos] == 0xFF {
+			pos++
+		}
+		if pos >= len(data) {
+			return nil, nil, fmt.Errorf("truncated JPEG marker at offset %d", start)
+		}
+		marker := data[pos]
+		pos++
+
+		if marker == markerEOI {
+			segments = append(segments, jpegSegment{marker: marker, raw: data[start:pos]})
+			return segments, data[pos:], nil
+		}
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			// Standalone markers carry no length
+			segments = append(segments, jpegSegment{marker: marker, raw: data[start:pos]})
+			continue
+		}
+
+		if pos+2 > len(data) {
+			return nil, nil, fmt.Errorf("truncated JPEG segment at offset %d", start)
+		}
+		length := int(binary.BigEndian.Uint16(data[pos:]))
+		if length < 2 || pos+length > len(data) {
+			return nil, nil, fmt.Errorf("invalid JPEG segment length at offset %d", start)
+		}
+		payload := data[pos+2 : pos+length]
+		pos += length
+
+		if marker == markerSOS {
+			pos = skipEntropyCodedData(data, pos)
+		}
+		segments = append(segments, jpegSegment{marker: marker, payload: payload, raw: data[start:pos]})
+	}
+
+	return nil, nil, errors.New("JPEG has no EOI marker")
+}
+
+// skipEntropyCodedData returns the offset of the first marker after the
+// scan data starting at pos. Stuffed zero bytes and restart markers are part
+// of the scan.
+func skipEntropyCodedData(data []byte, pos int) int {
+	for pos < len(data) {
+		i := bytes.IndexByte(data[pos:], 0xFF)
+		if i < 0 {
+			return len(data)
+		}
+		pos += i
+		if pos+1 >= len(data) {
+			return len(data)
+		}
+		next := data[pos+1]
+		if next == 0x00 || next >= 0xD0 && next <= 0xD7 {
+			pos += 2
+			continue
+		}
+		if next == 0xFF {
+			pos++
+			continue
+		}
+		return pos
+	}
+	return pos
+}
+
+// hasPrefix reports whether the segment payload starts with id.
+func (s jpegSegment) hasPrefix(id []byte) bool {
+	return bytes.HasPrefix(s.payload, id)
+}
+
+// appendJPEGSegment appends a length-prefixed marker segment to dst.
+func appendJPEGSegment(dst []byte, marker byte, payload []byte) ([]byte, error) {
+	if len(payload) > 0xFFFF-2 {
+		return nil, fmt.Errorf("JPEG segment payload too large: %d bytes", len(payload))
+	}
+	dst = append(dst, 0xFF, marker)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(payload)+2))
+	return append(dst, payload...), nil
+}
+
+var jfifID = []byte("JFIF\x00")
+
+// JPEGProcessor strips metadata from JPEG files segment by segment, leaving
+// the entropy-coded image data untouched. Images whose EXIF orientation is
+// not 1 are re-encoded with the orientation applied unless
+// Options.Orientation is OrientationTag, as are images with a redaction or
+// fingerprint mitigation.
+type JPEGProcessor struct{}
+
+// Process implements Processor.
+func (JPEGProcessor) Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading input: %w", err)
+	}
+
+	if err := opts.Limits.checkImage(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	segments, _, err := scanJPEG(data)
+	if err != nil {
+		return decodeError(fmt.Errorf("error reading JPEG segments: %w", err))
+	}
+
+	// Only the first EXIF block counts, as it does for decoders
+	source := &exifData{order: binary.BigEndian}
+	for _, s := range segments {
+		if s.marker == markerAPP1 && s.hasPrefix(jpegExifID) {
+			if parsed, err := parseEXIF(s.payload); err == nil {
+				source = parsed
+			}
+			break
+		}
+	}
+
+	orientation := source.orientation()
+	if (orientation != 1 && opts.Orientation != OrientationTag) || opts.reencodesImages() {
+		return convertToJpg(ctx, bytes.NewReader(data), w, nil, opts)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kept := source.filter(opts.Policy)
+	if orientation != 1 {
+		kept.setOrientation(orientation)
+	}
+
+	out, err := stripJPEGSegments(segments, kept, opts.Policy)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
+	return nil
+}
+
+// OutputExt implements FormatChanger.
+func (JPEGProcessor) OutputExt(opts Options) string {
+	return ".jpg"
+}
+
+// Inspect implements Inspector.
+func (JPEGProcessor) Inspect(ctx context.Context, r io.Reader) (*Report, error) {
+	return ImageProcessor{}.Inspect(ctx, r)
+}
+
+// stripJPEGSegments reassembles a JPEG from the segments that carry image
+// data, writing kept as the only EXIF block. EXIF, XMP, IPTC/Photoshop,
+// FlashPix, JUMBF/C2PA, MPF, comments and anything after EOI are dropped.
+// The ICC profile survives if the policy keeps it.
+func stripJPEGSegments(segments []jpegSegment, kept *exifData, policy Policy) ([]byte, error) {
+	out := make([]byte, 0, len(segments[len(segments)-1].raw)+64*1024)
+	wroteEXIF := len(kept.entries) == 0
+
+	for _, s := range segments {
+		// EXIF belongs after SOI and any JFIF header
+		if !wroteEXIF && s.marker != markerSOI && s.marker != markerAPP0 {
+			var err error
+			out, err = appendJPEGSegment(out, markerAPP1, kept.encode())
+			if err != nil {
+				return nil, fmt.Errorf("error writing retained EXIF: %w", err)
+			}
+			wroteEXIF = true
+		}
+
+		switch {
+		case s.marker == markerAPP0:
+			if !s.hasPrefix(jfifID) || len(s.payload) < 14 {
+				continue // JFXX thumbnails and other APP0 extensions
+			}
+			// Keep the JFIF header but drop its embedded thumbnail
+			header := append([]byte(nil), s.payload[:14]...)
+			header[12], header[13] = 0, 0
+			out, _ = appendJPEGSegment(out, markerAPP0, header)
+		case s.marker == markerAPP2 && s.hasPrefix(jpegICCID):
+			if policy.Keeps(GroupICCProfile) {
+				out = append(out, s.raw...)
+			}
+		case s.marker == markerAPP14:
+			// Adobe colour transform flags are needed to decode correctly
+			out = append(out, s.raw...)
+		case s.marker >= markerAPP1 && s.marker <= 0xEF, s.marker == markerCOM:
+			// Metadata
+		default:
+			out = append(out, s.raw...)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,182 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// testJPEG encodes a w x h image and inserts the given segments, each a
+// marker followed by its payload, right after SOI.
+func testJPEG(t *testing.T, w, h int, extra ...jpegSegment) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	out := append([]byte(nil), encoded[:2]...)
+	for _, s := range extra {
+		var err error
+		if out, err = appendJPEGSegment(out, s.marker, s.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return append(out, encoded[2:]...)
+}
+
+// testEXIF returns an EXIF block holding the orientation and camera make.
+func testEXIF(orientation int, camera string) []byte {
+	e := &exifData{order: binary.BigEndian}
+	e.setOrientation(orientation)
+	value := append([]byte(camera), 0)
+	e.entries = append(e.entries, exifEntry{ifd: ifd0, tag: 0x010F, typ: 2, count: uint32(len(value)), value: value})
+	return e.encode()
+}
+
+// segmentsWith returns the segments of data with the given marker.
+func segmentsWith(t *testing.T, data []byte, marker byte) []jpegSegment {
+	t.Helper()
+	segments, _, err := scanJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []jpegSegment
+	for _, s := range segments {
+		if s.marker == marker {
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+func processJPEG(t *testing.T, data []byte, opts Options) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := (JPEGProcessor{}).Process(context.Background(), bytes.NewReader(data), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestJPEGStripSegments(t *testing.T) {
+	icc := append(append([]byte(nil), jpegICCID...), 1, 1, 'p', 'r', 'o', 'f')
+	adobe := []byte("Adobe\x00\x64\x00\x00\x00\x00\x00")
+	data := testJPEG(t, 16, 8,
+		jpegSegment{marker: markerAPP1, payload: testEXIF(1, "Canon")},
+		jpegSegment{marker: markerAPP1, payload: append(append([]byte(nil), jpegXMPID...), "<x:xmpmeta/>"...)},
+		jpegSegment{marker: markerAPP2, payload: icc},
+		jpegSegment{marker: markerAPP11, payload: []byte("JP\x00\x00jumb")},
+		jpegSegment{marker: markerAPP14, payload: adobe},
+		jpegSegment{marker: markerCOM, payload: []byte("secret comment")},
+	)
+
+	tests := []struct {
+		name   string
+		policy Policy
+		icc    bool
+		camera bool
+	}{
+		{"strip all", Policy{}, false, false},
+		{"keep ICC", Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupICCProfile}}, true, false},
+		{"keep camera", Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupCamera}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := processJPEG(t, data, Options{Policy: tt.policy})
+
+			if n := len(segmentsWith(t, out, markerAPP11)); n != 0 {
+				t.Errorf("%d APP11 segments left", n)
+			}
+			if n := len(segmentsWith(t, out, markerCOM)); n != 0 {
+				t.Errorf("%d comments left", n)
+			}
+			app14 := segmentsWith(t, out, markerAPP14)
+			if len(app14) != 1 || !bytes.Equal(app14[0].payload, adobe) {
+				t.Errorf("APP14 segments = %d, want the Adobe segment unchanged", len(app14))
+			}
+			app2 := segmentsWith(t, out, markerAPP2)
+			if got := len(app2) == 1 && bytes.Equal(app2[0].payload, icc); got != tt.icc {
+				t.Errorf("ICC profile kept = %v, want %v", got, tt.icc)
+			}
+
+			app1 := segmentsWith(t, out, markerAPP1)
+			if !tt.camera {
+				if len(app1) != 0 {
+					t.Errorf("%d APP1 segments left", len(app1))
+				}
+			} else {
+				if len(app1) != 1 {
+					t.Fatalf("%d APP1 segments left, want the retained EXIF only", len(app1))
+				}
+				e, err := parseEXIF(app1[0].payload)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(e.entries) != 1 || e.entries[0].tag != 0x010F || string(e.entries[0].value) != "Canon\x00" {
+					t.Errorf("retained EXIF = %+v, want the make only", e.entries)
+				}
+			}
+
+			if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("output does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestJPEGStripSegmentsKeepsImageData(t *testing.T) {
+	data := testJPEG(t, 16, 8, jpegSegment{marker: markerCOM, payload: []byte("comment")})
+	out := processJPEG(t, data, Options{})
+	want := segmentsWith(t, data, markerSOS)
+	got := segmentsWith(t, out, markerSOS)
+	if len(got) != 1 || !bytes.Equal(got[0].raw, want[0].raw) {
+		t.Error("scan data changed")
+	}
+}
+
+func TestJPEGOrientationTag(t *testing.T) {
+	data := testJPEG(t, 16, 8, jpegSegment{marker: markerAPP1, payload: testEXIF(6, "Canon")})
+	out := processJPEG(t, data, Options{Orientation: OrientationTag})
+
+	app1 := segmentsWith(t, out, markerAPP1)
+	if len(app1) != 1 {
+		t.Fatalf("%d APP1 segments, want one holding the orientation", len(app1))
+	}
+	e, err := parseEXIF(app1[0].payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.entries) != 1 || e.orientation() != 6 {
+		t.Errorf("retained EXIF = %+v, want orientation 6 only", e.entries)
+	}
+	if !bytes.Equal(segmentsWith(t, out, markerSOS)[0].raw, segmentsWith(t, data, markerSOS)[0].raw) {
+		t.Error("scan data changed, want the image left as it was")
+	}
+}
+
+func TestJPEGOrientationBake(t *testing.T) {
+	data := testJPEG(t, 16, 8, jpegSegment{marker: markerAPP1, payload: testEXIF(6, "Canon")})
+	out := processJPEG(t, data, Options{})
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 8 || config.Height != 16 {
+		t.Errorf("baked image is %dx%d, want 8x16", config.Width, config.Height)
+	}
+	for _, s := range segmentsWith(t, out, markerAPP1) {
+		if e, err := parseEXIF(s.payload); err == nil && e.orientation() != 1 {
+			t.Errorf("baked image still has orientation %d", e.orientation())
+		}
+	}
+}
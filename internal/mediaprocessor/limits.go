@@ -0,0 +1,132 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// Limits bounds the resources a single file may take, so that a small file
+// declaring huge dimensions cannot exhaust memory when it is decoded. They
+// are checked against the image header or the FFprobe report before any
+// full decode. Zero fields are not limited.
+type Limits struct {
+	// MaxPixels caps the width times the height of images and video frames.
+	MaxPixels int64 `json:"max_pixels,omitempty"`
+	// MaxDimension caps the width and the height on their own.
+	MaxDimension int `json:"max_dimension,omitempty"`
+	// MaxInputBytes caps the size of the input file.
+	MaxInputBytes int64 `json:"max_input_bytes,omitempty"`
+	// MaxVideoDuration caps the length of videos, in seconds or as a
+	// timecode such as "1:00:00".
+	MaxVideoDuration Timecode `json:"max_video_duration,omitempty"`
+}
+
+// DefaultLimits suit a server accepting uploads from anyone: photos up to
+// 100 megapixels, 32768 pixels on a side, 2 GiB and an hour of video.
+var DefaultLimits = Limits{
+	MaxPixels:        100_000_000,
+	MaxDimension:     32768,
+	MaxInputBytes:    2 << 30,
+	MaxVideoDuration: 3600,
+}
+
+// Validate checks that no limit is negative.
+func (l Limits) Validate() error {
+	if l.MaxPixels < 0 || l.MaxDimension < 0 || l.MaxInputBytes < 0 || l.MaxVideoDuration < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+// CheckInputSize checks the size of an input file in bytes.
+func (l Limits) CheckInputSize(size int64) error {
+	if l.MaxInputBytes > 0 && size > l.MaxInputBytes {
+		return fmt.Errorf("%w: input is %d bytes, over the %d byte limit", ErrLimitExceeded, size, l.MaxInputBytes)
+	}
+	return nil
+}
+
+// checkDimensions checks the size of an image or video frame.
+func (l Limits) checkDimensions(width, height int) error {
+	if l.MaxDimension > 0 && (width > l.MaxDimension || height > l.MaxDimension) {
+		return fmt.Errorf("%w: %dx%d is over the %d pixel dimension limit", ErrLimitExceeded, width, height, l.MaxDimension)
+	}
+	if l.MaxPixels > 0 && int64(width)*int64(height) > l.MaxPixels {
+		return fmt.Errorf("%w: %dx%d is over the %d pixel limit", ErrLimitExceeded, width, height, l.MaxPixels)
+	}
+	return nil
+}
+
+// checkDuration checks the length of a video in seconds.
+func (l Limits) checkDuration(seconds float64) error {
+	if l.MaxVideoDuration > 0 && seconds > float64(l.MaxVideoDuration) {
+		return fmt.Errorf("%w: video is %gs long, over the %gs limit", ErrLimitExceeded, seconds, l.MaxVideoDuration)
+	}
+	return nil
+}
+
+// limitsVideo reports whether videos must be probed to check the limits.
+func (l Limits) limitsVideo() bool {
+	return l.MaxPixels > 0 || l.MaxDimension > 0 || l.MaxVideoDuration > 0
+}
+
+// checkImage reads the dimensions an image declares in its header and
+// checks them, then rewinds r for the decoder.
+func (l Limits) checkImage(r io.ReadSeeker) error {
+	if l.MaxPixels <= 0 && l.MaxDimension <= 0 {
+		return nil
+	}
+	config, _, err := image.DecodeConfig(r)
+	if _, seekErr := r.Seek(0, io.SeekStart); seekErr != nil {
+		return fmt.Errorf("error resetting file pointer: %w", seekErr)
+	}
+	if err != nil {
+		return decodeError(fmt.Errorf("error reading image dimensions: %w", err))
+	}
+	return l.checkDimensions(config.Width, config.Height)
+}
+
+// limitInput checks the size of r when it is known up front. Otherwise r is
+// wrapped in a reader that fails once more than MaxInputBytes are read.
+func (l Limits) limitInput(r io.Reader) (io.Reader, error) {
+	if l.MaxInputBytes <= 0 {
+		return r, nil
+	}
+	switch sized := r.(type) {
+	case *os.File:
+		if info, err := sized.Stat(); err == nil && info.Mode().IsRegular() {
+			return r, l.CheckInputSize(info.Size())
+		}
+	case interface{ Size() int64 }:
+		// Such as bytes.Reader and in-memory multipart files
+		return r, l.CheckInputSize(sized.Size())
+	}
+	return &limitedReader{r: r, remaining: l.MaxInputBytes, limits: l}, nil
+}
+
+// limitedReader fails reads past the input size limit and remembers that it
+// did, as processors may not pass the error on as it is.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+	limits    Limits
+	err       error
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	if int64(len(p)) > lr.remaining+1 {
+		p = p[:lr.remaining+1]
+	}
+	n, err := lr.r.Read(p)
+	if int64(n) > lr.remaining {
+		lr.err = fmt.Errorf("%w: input is over the %d byte limit", ErrLimitExceeded, lr.limits.MaxInputBytes)
+		return int(lr.remaining), lr.err
+	}
+	lr.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,694 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// bmffContainers are the boxes inside moov whose children are rewritten.
+// Other boxes are copied as they are unless they are dropped or patched.
+var bmffContainers = map[string]bool{
+	"moov": true,
+	"trak": true,
+	"edts": true,
+	"mdia": true,
+	"minf": true,
+	"dinf": true,
+	"stbl": true,
+	"mvex": true,
+}
+
+// bmffDropped are boxes removed wherever they appear. meta holds iTunes and
+// QuickTime metadata items (including Apple's location key), uuid holds XMP
+// and vendor blobs, and free space can carry leftovers of earlier edits.
+// Track references only point at the timecode and chapter tracks that are
+// dropped.
+var bmffDropped = map[string]bool{
+	"meta":    true,
+	"tref":    true,
+	"uuid":    true,
+	"free":    true,
+	"skip":    true,
+	"wide":    true,
+	"\xa9xyz": true,
+	"\xa9mak": true,
+	"\xa9mod": true,
+}
+
+// userDataTagGroups assigns QuickTime user data atoms to the policy groups
+// that govern them. Atoms not listed here are never retained.
+var userDataTagGroups = map[string]TagGroup{
+	"\xa9day": GroupCaptureDate,
+	"cprt":    GroupCopyright,
+	"\xa9cpy": GroupCopyright,
+	"\xa9ART": GroupCopyright,
+	"\xa9aut": GroupCopyright,
+	"\xa9nam": GroupDescription,
+	"\xa9des": GroupDescription,
+	"\xa9cmt": GroupDescription,
+	"\xa9inf": GroupDescription,
+	"\xa9mak": GroupCamera,
+	"\xa9mod": GroupCamera,
+	"\xa9swr": GroupSoftware,
+	"\xa9too": GroupSoftware,
+	"\xa9xyz": GroupGPS,
+}
+
+// trackTypes names the kind of track for each handler type. Only video and
+// audio tracks are kept. Everything else is dropped, including timecode,
+// subtitle and chapter tracks and timed metadata such as Apple location
+// tracks and GoPro GPMF telemetry, which are reported as data.
+var trackTypes = map[string]string{
+	"vide": "video",
+	"soun": "audio",
+	"text": "subtitle",
+	"sbtl": "subtitle",
+	"subt": "subtitle",
+	"clcp": "subtitle",
+}
+
+var errFragmentedBMFF = fmt.Errorf("%w: fragmented MP4 files are not supported without re-encoding", ErrUnsupportedFormat)
+
+// rewriteVideo scrubs an MP4 or QuickTime stream at the box level. The
+// stream is spooled to a temporary file unless it already is one, as boxes
+// are read out of order.
+func rewriteVideo(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	input, ok := r.(*os.File)
+	if !ok || !isRegularFile(input) {
+		inputPath, cleanup, err := spoolToFile(r, opts.scratch())
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+
+		input, err = os.Open(inputPath)
+		if err != nil {
+			return fmt.Errorf("error opening temporary input file: %w", err)
+		}
+		defer input.Close()
+	}
+
+	info, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading input: %w", err)
+	}
+	return rewriteBMFF(ctx, input, info.Size(), w, opts)
+}
+
+// rewriteBMFF copies an ISO base media file from r to w keeping only the
+// ftyp, moov and mdat boxes. The movie box is rebuilt without metadata boxes
+// or timed-metadata tracks, the samples of dropped tracks are zeroed, and
+// chunk offsets are moved to the new positions of the media data.
+func rewriteBMFF(ctx context.Context, r io.ReaderAt, size int64, w io.Writer, opts Options) error {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return decodeError(err)
+	}
+	if _, fragmented := findBox(top, "moof"); fragmented {
+		return errFragmentedBMFF
+	}
+	moovBox, found := findBox(top, "moov")
+	if !found {
+		return fmt.Errorf("%w: no moov box found", ErrDecodeFailed)
+	}
+	if opts.Limits.MaxVideoDuration > 0 {
+		seconds, err := movieDuration(r, moovBox)
+		if err != nil {
+			return decodeError(err)
+		}
+		if err := opts.Limits.checkDuration(seconds); err != nil {
+			return err
+		}
+	}
+
+	moov := make([]byte, moovBox.size())
+	if _, err := r.ReadAt(moov, moovBox.start); err != nil {
+		return decodeError(fmt.Errorf("error reading moov box: %w", err))
+	}
+
+	// The new movie box has the same size whatever the chunk offsets are,
+	// so it is built once to lay the file out and again with real offsets
+	rw := &moovRewriter{policy: opts.Policy, shift: func(offset int64) (int64, error) { return offset, nil }}
+	newMoov, err := rw.rewrite(moov)
+	if err != nil {
+		return decodeError(err)
+	}
+
+	var kept []bmffBox
+	newStart := map[int64]int64{}
+	var pos int64
+	for _, b := range top {
+		switch b.typ {
+		case "ftyp", "mdat":
+			newStart[b.start] = pos
+			pos += b.size()
+		case "moov":
+			newStart[b.start] = pos
+			pos += int64(len(newMoov))
+		default:
+			continue
+		}
+		kept = append(kept, b)
+	}
+
+	rw.shift = func(offset int64) (int64, error) {
+		for _, b := range kept {
+			if b.typ == "mdat" && offset >= b.bodyStart() && offset <= b.end {
+				return offset - b.start + newStart[b.start], nil
+			}
+		}
+		return 0, fmt.Errorf("chunk offset %d is outside the media data", offset)
+	}
+	newMoov, err = rw.rewrite(moov)
+	if err != nil {
+		return decodeError(err)
+	}
+	opts.reportDropped(rw.droppedTracks)
+
+	// pos is now the size of the output
+	progress := &progressWriter{w: w, total: pos, report: opts.reportProgress}
+	for _, b := range kept {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if b.typ == "moov" {
+			_, err = progress.Write(newMoov)
+		} else {
+			err = copyBoxZeroing(ctx, progress, r, b, rw.dropped)
+		}
+		if err != nil {
+			return fmt.Errorf("error writing output: %w", err)
+		}
+	}
+	return nil
+}
+
+// moovRewriter rebuilds a movie box according to a policy.
+type moovRewriter struct {
+	policy Policy
+	// shift maps a chunk offset in the source to the output
+	shift func(offset int64) (int64, error)
+	// dropped lists the byte ranges of samples from removed tracks
+	dropped []byteRange
+	// droppedTracks describes the removed tracks
+	droppedTracks []DroppedTrack
+	// tracks counts the tracks seen so far
+	tracks int
+	// handler is the handler type of the track being rewritten
+	handler string
+}
+
+// byteRange is a half-open range of file offsets.
+type byteRange struct{ start, end int64 }
+
+// rewrite returns the rebuilt movie box, header included.
+func (rw *moovRewriter) rewrite(moov []byte) ([]byte, error) {
+	rw.dropped, rw.droppedTracks, rw.tracks = nil, nil, 0
+	return rw.appendBoxes(nil, moov, 0, int64(len(moov)))
+}
+
+// appendBoxes appends the rewritten form of the boxes found in
+// data[start:end] to dst.
+func (rw *moovRewriter) appendBoxes(dst, data []byte, start, end int64) ([]byte, error) {
+	boxes, err := readBoxes(bytes.NewReader(data), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range boxes {
+		raw := data[b.start:b.end]
+		switch {
+		case b.typ == "udta":
+			dst = rw.appendUserData(dst, data, b)
+		case bmffDropped[b.typ]:
+			// Removed along with everything inside it
+		case b.typ == "trak":
+			index := rw.tracks
+			rw.tracks++
+			handler := trackHandler(data, b)
+			if handler == "vide" || handler == "soun" {
+				rw.handler = handler
+				body, err := rw.appendBoxes(nil, data, b.bodyStart(), b.end)
+				if err != nil {
+					return nil, err
+				}
+				dst = appendBox(dst, b.typ, body)
+				continue
+			}
+
+			ranges, err := trackChunkRanges(data, b)
+			if err != nil {
+				return nil, err
+			}
+			rw.dropped = append(rw.dropped, ranges...)
+
+			kind, known := trackTypes[handler]
+			if !known {
+				kind = "data"
+			}
+			rw.droppedTracks = append(rw.droppedTracks, DroppedTrack{Index: index, Type: kind, Codec: trackSampleFormat(data, b)})
+		case bmffContainers[b.typ]:
+			body, err := rw.appendBoxes(nil, data, b.bodyStart(), b.end)
+			if err != nil {
+				return nil, err
+			}
+			dst = appendBox(dst, b.typ, body)
+		case b.typ == "stco" || b.typ == "co64":
+			patched, err := rw.shiftChunkOffsets(raw, b)
+			if err != nil {
+				return nil, err
+			}
+			dst = append(dst, patched...)
+		case (b.typ == "mvhd" || b.typ == "tkhd" || b.typ == "mdhd") && !rw.policy.Keeps(GroupCaptureDate):
+			dst = append(dst, clearBoxTimes(raw, b.headerLen)...)
+		case b.typ == "hdlr":
+			dst = appendBox(dst, b.typ, clearHandlerName(raw[b.headerLen:]))
+		case b.typ == "stsd" && rw.handler == "vide":
+			dst = append(dst, clearCompressorNames(raw, b.headerLen)...)
+		default:
+			dst = append(dst, raw...)
+		}
+	}
+	return dst, nil
+}
+
+// appendUserData appends a user data box holding only the atoms the policy
+// keeps. Nothing is appended if no atom survives.
+func (rw *moovRewriter) appendUserData(dst, data []byte, udta bmffBox) []byte {
+	boxes, err := readBoxes(bytes.NewReader(data), udta.bodyStart(), udta.end)
+	if err != nil {
+		return dst // Unreadable user data is dropped
+	}
+
+	var body []byte
+	for _, b := range boxes {
+		group, known := userDataTagGroups[b.typ]
+		if known && rw.policy.Keeps(group) {
+			body = append(body, data[b.start:b.end]...)
+		}
+	}
+	if len(body) == 0 {
+		return dst
+	}
+	return appendBox(dst, "udta", body)
+}
+
+// shiftChunkOffsets returns a copy of an stco or co64 box with every chunk
+// offset moved to the output layout.
+func (rw *moovRewriter) shiftChunkOffsets(raw []byte, b bmffBox) ([]byte, error) {
+	patched := append([]byte(nil), raw...)
+	offsets, width, err := chunkOffsetTable(patched, b)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(offsets); i += width {
+		var offset int64
+		if width == 8 {
+			offset = int64(binary.BigEndian.Uint64(offsets[i:]))
+		} else {
+			offset = int64(binary.BigEndian.Uint32(offsets[i:]))
+		}
+
+		offset, err := rw.shift(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if width == 8 {
+			binary.BigEndian.PutUint64(offsets[i:], uint64(offset))
+		} else if offset > math.MaxUint32 {
+			return nil, fmt.Errorf("chunk offset %d does not fit in an stco box", offset)
+		} else {
+			binary.BigEndian.PutUint32(offsets[i:], uint32(offset))
+		}
+	}
+	return patched, nil
+}
+
+// chunkOffsetTable returns the offset entries of an stco or co64 box held in
+// raw, and the width of each entry.
+func chunkOffsetTable(raw []byte, b bmffBox) ([]byte, int, error) {
+	width := 4
+	if b.typ == "co64" {
+		width = 8
+	}
+	body := raw[b.headerLen:]
+	if len(body) < 8 {
+		return nil, 0, fmt.Errorf("%q box is too short", b.typ)
+	}
+	count := int64(binary.BigEndian.Uint32(body[4:8]))
+	if count*int64(width) > int64(len(body)-8) {
+		return nil, 0, fmt.Errorf("%q box is too short for %d entries", b.typ, count)
+	}
+	return body[8 : 8+count*int64(width)], width, nil
+}
+
+// movieDuration returns the length of the movie in seconds from its mvhd
+// box, or 0 when the box leaves it unknown.
+func movieDuration(r io.ReaderAt, moov bmffBox) (float64, error) {
+	mvhd, found := findPath(r, moov, "mvhd")
+	if !found {
+		return 0, fmt.Errorf("no mvhd box found")
+	}
+	body, err := readBoxBody(r, mvhd, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// Version 1 has 64-bit times and duration around the 32-bit timescale
+	var timescale, duration uint64
+	switch {
+	case len(body) >= 32 && body[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(body[20:24]))
+		duration = binary.BigEndian.Uint64(body[24:32])
+	case len(body) >= 20 && body[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(body[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:20]))
+	default:
+		return 0, fmt.Errorf("invalid mvhd box")
+	}
+	if timescale == 0 || duration == math.MaxUint32 || duration == math.MaxUint64 {
+		return 0, nil
+	}
+	return float64(duration) / float64(timescale), nil
+}
+
+// clearBoxTimes returns a copy of an mvhd, tkhd or mdhd box with its
+// creation and modification times set to zero.
+func clearBoxTimes(raw []byte, headerLen int64) []byte {
+	cleared := append([]byte(nil), raw...)
+	body := cleared[headerLen:]
+	width := 4
+	if len(body) > 0 && body[0] == 1 {
+		width = 8
+	}
+	if len(body) >= 4+2*width {
+		clear(body[4 : 4+2*width])
+	}
+	return cleared
+}
+
+// clearHandlerName returns the body of an hdlr box with an empty name.
+// Recorders often name their handlers after the device, as in "GoPro AVC".
+// A single zero byte is an empty string in both the MP4 and the QuickTime
+// (Pascal string) encodings.
+func clearHandlerName(body []byte) []byte {
+	const fixed = 24 // Version and flags, component type and subtype, reserved
+	if len(body) <= fixed {
+		return body
+	}
+	return append(append([]byte(nil), body[:fixed]...), 0)
+}
+
+// clearCompressorNames returns a copy of a video stsd box with the
+// compressor name of every sample description cleared, as it may name the
+// recording device.
+func clearCompressorNames(raw []byte, headerLen int64) []byte {
+	cleared := append([]byte(nil), raw...)
+	// Version, flags and entry count precede the sample descriptions
+	entries, err := readBoxes(bytes.NewReader(cleared), headerLen+8, int64(len(cleared)))
+	if err != nil {
+		return cleared
+	}
+	// The 32-byte name follows 42 bytes of visual sample entry fields
+	const nameOffset, nameLen = 8 + 42, 32
+	for _, e := range entries {
+		if e.size() >= nameOffset+nameLen {
+			clear(cleared[e.start+nameOffset : e.start+nameOffset+nameLen])
+		}
+	}
+	return cleared
+}
+
+// trackHandler returns the handler type of a trak box, or "" if it has none.
+func trackHandler(data []byte, trak bmffBox) string {
+	r := bytes.NewReader(data)
+	hdlr, found := findPath(r, trak, "mdia", "hdlr")
+	if !found {
+		return ""
+	}
+	// Version and flags, then the QuickTime component type
+	body, err := readBoxBody(r, hdlr, 8)
+	if err != nil || len(body) < 4 {
+		return ""
+	}
+	return string(body[:4])
+}
+
+// trackSampleFormat returns the format of the first sample description of a
+// trak box, such as "avc1" or "gpmd", or "" if it has none.
+func trackSampleFormat(data []byte, trak bmffBox) string {
+	r := bytes.NewReader(data)
+	stsd, found := findPath(r, trak, "mdia", "minf", "stbl", "stsd")
+	if !found {
+		return ""
+	}
+	// Version, flags and entry count, then the first entry's header
+	body, err := readBoxBody(r, stsd, 8)
+	if err != nil || len(body) < 8 {
+		return ""
+	}
+	return string(body[4:8])
+}
+
+// trackChunkRanges returns the byte ranges holding the samples of a track,
+// worked out from its sample table.
+func trackChunkRanges(data []byte, trak bmffBox) ([]byteRange, error) {
+	r := bytes.NewReader(data)
+	stbl, found := findPath(r, trak, "mdia", "minf", "stbl")
+	if !found {
+		return nil, nil // A track without samples
+	}
+	boxes, err := readBoxes(r, stbl.bodyStart(), stbl.end)
+	if err != nil {
+		return nil, err
+	}
+
+	var offsets []int64
+	if b, found := findBox(boxes, "stco"); found {
+		table, _, err := chunkOffsetTable(data[b.start:b.end], b)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(table); i += 4 {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(table[i:])))
+		}
+	} else if b, found := findBox(boxes, "co64"); found {
+		table, _, err := chunkOffsetTable(data[b.start:b.end], b)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < len(table); i += 8 {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(table[i:])))
+		}
+	}
+	if len(offsets) == 0 {
+		return nil, nil
+	}
+
+	stsc, foundStsc := findBox(boxes, "stsc")
+	stsz, foundStsz := findBox(boxes, "stsz")
+	if !foundStsc || !foundStsz {
+		return nil, fmt.Errorf("incomplete sample table in %q box at offset %d", stbl.typ, stbl.start)
+	}
+	toChunk, err := readBoxBody(r, stsc, 4)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := readBoxBody(r, stsz, 4)
+	if err != nil {
+		return nil, err
+	}
+	if len(toChunk) < 4 || len(sizes) < 8 {
+		return nil, fmt.Errorf("invalid sample table in %q box at offset %d", stbl.typ, stbl.start)
+	}
+
+	entries := int(binary.BigEndian.Uint32(toChunk))
+	if entries > (len(toChunk)-4)/12 {
+		return nil, fmt.Errorf("%q box is too short for %d entries", "stsc", entries)
+	}
+	fixedSize := int64(binary.BigEndian.Uint32(sizes))
+	sampleCount := int(binary.BigEndian.Uint32(sizes[4:]))
+	if fixedSize == 0 && sampleCount > (len(sizes)-8)/4 {
+		return nil, fmt.Errorf("%q box is too short for %d entries", "stsz", sampleCount)
+	}
+	sampleSize := func(i int) int64 {
+		if fixedSize != 0 {
+			return fixedSize
+		}
+		return int64(binary.BigEndian.Uint32(sizes[8+4*i:]))
+	}
+
+	var ranges []byteRange
+	sample := 0
+	for entry := 0; entry < entries; entry++ {
+		first := int(binary.BigEndian.Uint32(toChunk[4+12*entry:]))
+		perChunk := int(binary.BigEndian.Uint32(toChunk[8+12*entry:]))
+		last := len(offsets)
+		if entry+1 < entries {
+			last = int(binary.BigEndian.Uint32(toChunk[4+12*(entry+1):])) - 1
+		}
+		for chunk := first; chunk <= last && chunk >= 1 && chunk <= len(offsets); chunk++ {
+			var length int64
+			for i := 0; i < perChunk && sample < sampleCount; i++ {
+				length += sampleSize(sample)
+				sample++
+			}
+			start := offsets[chunk-1]
+			ranges = append(ranges, byteRange{start: start, end: start + length})
+		}
+	}
+	return ranges, nil
+}
+
+// appendBox appends a box with the given type and body to dst.
+func appendBox(dst []byte, typ string, body []byte) []byte {
+	size := uint64(len(body)) + 8
+	if size > math.MaxUint32 {
+		dst = binary.BigEndian.AppendUint32(dst, 1)
+		dst = append(dst, typ...)
+		dst = binary.BigEndian.AppendUint64(dst, size+8)
+	} else {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(size))
+		dst = append(dst, typ...)
+	}
+	return append(dst, body...)
+}
+
+// copyBoxZeroing copies box b from r to w, writing zeros in place of any
+// bytes covered by the zero ranges.
+func copyBoxZeroing(ctx context.Context, w io.Writer, r io.ReaderAt, b bmffBox, zero []byteRange) error {
+	var within []byteRange
+	for _, z := range zero {
+		start, end := max(z.start, b.bodyStart()), min(z.end, b.end)
+		if start < end {
+			within = append(within, byteRange{start: start, end: end})
+		}
+	}
+	sort.Slice(within, func(i, j int) bool { return within[i].start < within[j].start })
+
+	const chunkSize = 1 << 20
+	buf := make([]byte, chunkSize)
+	for pos := b.start; pos < b.end; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n := min(int64(chunkSize), b.end-pos)
+		if _, err := r.ReadAt(buf[:n], pos); err != nil {
+			return err
+		}
+		for _, z := range within {
+			start, end := max(z.start, pos), min(z.end, pos+n)
+			if start < end {
+				clear(buf[start-pos : end-pos])
+			}
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		pos += n
+	}
+	return nil
+}
+
+// bmffFindings lists the metadata in an ISO base media file that the policy
+// does not keep, checking its boxes by the rules rewriteBMFF applies. It
+// verifies videos where FFprobe is unavailable.
+func bmffFindings(r io.ReaderAt, size int64, policy Policy) ([]Finding, error) {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	moovBox, found := findBox(top, "moov")
+	if !found {
+		return nil, fmt.Errorf("no moov box found")
+	}
+
+	v := &bmffVerifier{policy: policy}
+	for _, b := range top {
+		if b.typ != "ftyp" && b.typ != "moov" && b.typ != "mdat" {
+			v.findings = append(v.findings, Finding{Kind: "other", Detail: fmt.Sprintf("%q box", b.typ)})
+		}
+	}
+
+	moov := make([]byte, moovBox.size())
+	if _, err := r.ReadAt(moov, moovBox.start); err != nil {
+		return nil, fmt.Errorf("error reading moov box: %w", err)
+	}
+	if err := v.check(moov, 0, int64(len(moov))); err != nil {
+		return nil, err
+	}
+	sortFindings(v.findings)
+	return v.findings, nil
+}
+
+// bmffVerifier gathers the findings in a movie box.
+type bmffVerifier struct {
+	policy   Policy
+	findings []Finding
+	// tracks counts the tracks seen so far
+	tracks int
+}
+
+// check adds the findings in the boxes found in data[start:end].
+func (v *bmffVerifier) check(data []byte, start, end int64) error {
+	boxes, err := readBoxes(bytes.NewReader(data), start, end)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range boxes {
+		raw := data[b.start:b.end]
+		switch {
+		case b.typ == "udta":
+			atoms, err := readBoxes(bytes.NewReader(data), b.bodyStart(), b.end)
+			if err != nil {
+				v.findings = append(v.findings, Finding{Kind: "other", Detail: "unreadable udta box"})
+				continue
+			}
+			for _, atom := range atoms {
+				group, known := userDataTagGroups[atom.typ]
+				if !known || !v.policy.Keeps(group) {
+					v.findings = append(v.findings, Finding{Kind: "container-tag", Detail: atom.typ})
+				}
+			}
+		case bmffDropped[b.typ]:
+			v.findings = append(v.findings, Finding{Kind: "other", Detail: fmt.Sprintf("%q box", b.typ)})
+		case b.typ == "trak":
+			index := v.tracks
+			v.tracks++
+			handler := trackHandler(data, b)
+			if handler != "vide" && handler != "soun" {
+				kind, known := trackTypes[handler]
+				if !known {
+					kind = "data"
+				}
+				v.findings = append(v.findings, Finding{Kind: "data-track", Detail: fmt.Sprintf("%d (%s %s)", index, kind, trackSampleFormat(data, b))})
+				continue
+			}
+			if err := v.check(data, b.bodyStart(), b.end); err != nil {
+				return err
+			}
+		case bmffContainers[b.typ]:
+			if err := v.check(data, b.bodyStart(), b.end); err != nil {
+				return err
+			}
+		case (b.typ == "mvhd" || b.typ == "tkhd" || b.typ == "mdhd") && !v.policy.Keeps(GroupCaptureDate):
+			if !bytes.Equal(raw, clearBoxTimes(raw, b.headerLen)) {
+				v.findings = append(v.findings, Finding{Kind: "container-tag", Detail: "creation_time in " + b.typ})
+			}
+		case b.typ == "hdlr":
+			if body := raw[b.headerLen:]; !bytes.Equal(bytes.TrimRight(clearHandlerName(body), "\x00"), bytes.TrimRight(body, "\x00")) {
+				v.findings = append(v.findings, Finding{Kind: "stream-tag", Detail: fmt.Sprintf("handler_name on track %d", v.tracks-1)})
+			}
+		}
+	}
+	return nil
+}
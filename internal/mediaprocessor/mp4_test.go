@@ -0,0 +1,194 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// testChunks are the samples of the test movie, one per chunk.
+var testChunks = [][]byte{[]byte("first chunk"), []byte("second"), []byte("third and last chunk")}
+
+// testMP4 builds a movie with one video track whose chunk offsets are held
+// in an offsetBox ("stco" or "co64") box. A free box sits between ftyp and
+// moov, and moov holds udta, meta and free boxes, all of which come before
+// mdat. It returns the file and the number of bytes those boxes take up.
+func testMP4(offsetBox string) ([]byte, int) {
+	ftyp := appendBox(nil, "ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	free := appendBox(nil, "free", bytes.Repeat([]byte("leftover "), 10))
+	udta := appendBox(nil, "udta", appendBox(nil, "\xa9xyz", []byte("\x00\x12\x15\xc7+37.7749-122.4194/")))
+	meta := appendBox(nil, "meta", append(make([]byte, 4), appendBox(nil, "hdlr", make([]byte, 25))...))
+	innerFree := appendBox(nil, "free", make([]byte, 16))
+
+	var mdatBody []byte
+	var offsets []int64
+	for _, chunk := range testChunks {
+		offsets = append(offsets, int64(len(mdatBody)))
+		mdatBody = append(mdatBody, chunk...)
+		mdatBody = append(mdatBody, 0xAA, 0xBB) // Bytes between the chunks
+	}
+
+	buildMoov := func(base int64) []byte {
+		table := binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(offsets)))
+		for _, offset := range offsets {
+			if offsetBox == "co64" {
+				table = binary.BigEndian.AppendUint64(table, uint64(base+offset))
+			} else {
+				table = binary.BigEndian.AppendUint32(table, uint32(base+offset))
+			}
+		}
+		hdlr := make([]byte, 25) // Version and flags, component type, handler type, reserved and an empty name
+		copy(hdlr[8:], "vide")
+		stbl := appendBox(nil, "stsd", make([]byte, 8))
+		stbl = appendBox(stbl, offsetBox, table)
+		mdia := appendBox(nil, "mdhd", make([]byte, 24))
+		mdia = appendBox(mdia, "hdlr", hdlr)
+		mdia = appendBox(mdia, "minf", appendBox(nil, "stbl", stbl))
+		trak := appendBox(nil, "tkhd", make([]byte, 84))
+		trak = appendBox(trak, "mdia", mdia)
+
+		moov := appendBox(nil, "mvhd", make([]byte, 100))
+		moov = append(moov, udta...)
+		moov = appendBox(moov, "trak", trak)
+		moov = append(moov, meta...)
+		moov = append(moov, innerFree...)
+		return appendBox(nil, "moov", moov)
+	}
+
+	// The size of moov does not depend on the offsets it holds
+	mdatStart := len(ftyp) + len(free) + len(buildMoov(0))
+	data := append(append(ftyp, free...), buildMoov(int64(mdatStart)+8)...)
+	data = appendBox(data, "mdat", mdatBody)
+	return data, len(free) + len(udta) + len(meta) + len(innerFree)
+}
+
+// mp4ChunkOffsets returns the chunk offsets of the only track in data.
+func mp4ChunkOffsets(t *testing.T, data []byte) []int64 {
+	t.Helper()
+	r := bytes.NewReader(data)
+	top, err := readBoxes(r, 0, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moov, found := findBox(top, "moov")
+	if !found {
+		t.Fatal("no moov box")
+	}
+	for _, typ := range []string{"stco", "co64"} {
+		b, found := findPath(r, moov, "trak", "mdia", "minf", "stbl", typ)
+		if !found {
+			continue
+		}
+		table, width, err := chunkOffsetTable(data[b.start:b.end], b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var offsets []int64
+		for i := 0; i < len(table); i += width {
+			if width == 8 {
+				offsets = append(offsets, int64(binary.BigEndian.Uint64(table[i:])))
+			} else {
+				offsets = append(offsets, int64(binary.BigEndian.Uint32(table[i:])))
+			}
+		}
+		return offsets
+	}
+	t.Fatal("no chunk offset box")
+	return nil
+}
+
+func TestRewriteBMFF(t *testing.T) {
+	for _, offsetBox := range []string{"stco", "co64"} {
+		t.Run(offsetBox, func(t *testing.T) {
+			data, removed := testMP4(offsetBox)
+
+			var out bytes.Buffer
+			if err := rewriteBMFF(context.Background(), bytes.NewReader(data), int64(len(data)), &out, Options{}); err != nil {
+				t.Fatal(err)
+			}
+			got := out.Bytes()
+
+			if n := len(data) - len(got); n != removed {
+				t.Errorf("output is %d bytes smaller, want %d", n, removed)
+			}
+			top, err := readBoxes(bytes.NewReader(got), 0, int64(len(got)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var types []string
+			for _, b := range top {
+				types = append(types, b.typ)
+			}
+			if len(types) != 3 || types[0] != "ftyp" || types[1] != "moov" || types[2] != "mdat" {
+				t.Errorf("top-level boxes = %q, want ftyp, moov and mdat", types)
+			}
+			for _, typ := range []string{"udta", "meta", "free", "\xa9xyz"} {
+				if bytes.Contains(got, []byte(typ)) {
+					t.Errorf("output still holds a %q box", typ)
+				}
+			}
+
+			before := mp4ChunkOffsets(t, data)
+			after := mp4ChunkOffsets(t, got)
+			if len(after) != len(before) {
+				t.Fatalf("%d chunk offsets, want %d", len(after), len(before))
+			}
+			for i := range before {
+				if after[i] != before[i]-int64(removed) {
+					t.Errorf("chunk %d moved from %d to %d, want %d", i, before[i], after[i], before[i]-int64(removed))
+				}
+				chunk := testChunks[i]
+				if end := after[i] + int64(len(chunk)); end > int64(len(got)) || !bytes.Equal(got[after[i]:end], chunk) {
+					t.Errorf("chunk %d does not point at its samples", i)
+				}
+			}
+		})
+	}
+}
+
+func TestBMFFFindings(t *testing.T) {
+	data, _ := testMP4("stco")
+	findings, err := bmffFindings(bytes.NewReader(data), int64(len(data)), Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Finding{
+		{Kind: "container-tag", Detail: "\xa9xyz"},
+		{Kind: "other", Detail: `"free" box`},
+		{Kind: "other", Detail: `"free" box`},
+		{Kind: "other", Detail: `"meta" box`},
+	}
+	if !reflect.DeepEqual(findings, want) {
+		t.Errorf("findings = %q, want %q", findings, want)
+	}
+
+	// The location is kept only when the policy allows it
+	var out bytes.Buffer
+	policy := Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupGPS}}
+	if err := rewriteBMFF(context.Background(), bytes.NewReader(data), int64(len(data)), &out, Options{Policy: policy}); err != nil {
+		t.Fatal(err)
+	}
+	if findings, err := bmffFindings(bytes.NewReader(out.Bytes()), int64(out.Len()), policy); err != nil || len(findings) != 0 {
+		t.Errorf("findings in the scrubbed movie = %q, %v, want none", findings, err)
+	}
+}
+
+// TestProcessVideoWithoutTranscoder checks that MP4 files are scrubbed and
+// verified without FFmpeg.
+func TestProcessVideoWithoutTranscoder(t *testing.T) {
+	transcoder := DefaultTranscoder
+	DefaultTranscoder = &fakeTranscoder{Err: fmt.Errorf("%w: FFprobe not found", ErrTranscoderUnavailable)}
+	t.Cleanup(func() { DefaultTranscoder = transcoder })
+
+	data, removed := testMP4("co64")
+	var out bytes.Buffer
+	if err := Process(context.Background(), bytes.NewReader(data), &out, ".mp4", Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(data) - out.Len(); n != removed {
+		t.Errorf("output is %d bytes smaller, want %d", n, removed)
+	}
+}
@@ -0,0 +1,230 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// ApplyOrientation returns img turned upright according to its EXIF
+// orientation (1-8). YCbCr, RGBA and NRGBA images are transformed by copying
+// their pixel rows directly, keeping their type; anything else is converted
+// to RGBA first. The work is split across CPUs by bands of rows.
+func ApplyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 1 || orientation > 8 {
+		fmt.Printf("Warning: Unknown orientation %d, returning original image\n", orientation)
+		return img
+	}
+	if orientation == 1 {
+		return img // No rotation needed
+	}
+
+	switch src := img.(type) {
+	case *image.YCbCr:
+		if dst, ok := orientYCbCr(src, orientation); ok {
+			return dst
+		}
+	case *image.RGBA:
+		dst := image.NewRGBA(orientedRect(src.Rect, orientation))
+		orientPlane(pixelPlane(dst.Pix, dst.Stride, dst.Rect, 4), pixelPlane(src.Pix, src.Stride, src.Rect, 4), orientation)
+		return dst
+	case *image.NRGBA:
+		dst := image.NewNRGBA(orientedRect(src.Rect, orientation))
+		orientPlane(pixelPlane(dst.Pix, dst.Stride, dst.Rect, 4), pixelPlane(src.Pix, src.Stride, src.Rect, 4), orientation)
+		return dst
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	return ApplyOrientation(rgba, orientation)
+}
+
+// transposes reports whether the orientation swaps width and height.
+func transposes(orientation int) bool {
+	return orientation >= 5
+}
+
+// orientedRect returns the bounds, at the origin, of r once oriented.
+func orientedRect(r image.Rectangle, orientation int) image.Rectangle {
+	if transposes(orientation) {
+		return image.Rect(0, 0, r.Dy(), r.Dx())
+	}
+	return image.Rect(0, 0, r.Dx(), r.Dy())
+}
+
+// plane is a rectangle of pixels, each size bytes long, starting at the
+// beginning of pix.
+type plane struct {
+	pix           []byte
+	stride        int
+	width, height int
+	size          int
+}
+
+func pixelPlane(pix []byte, stride int, r image.Rectangle, size int) plane {
+	return plane{pix: pix, stride: stride, width: r.Dx(), height: r.Dy(), size: size}
+}
+
+// orientPlane writes src to dst with the orientation applied. dst must have
+// the oriented dimensions of src. Destination pixel (x, y) comes from source
+// pixel:
+//
+//	2: (w-1-x, y)      flip horizontal
+//	3: (w-1-x, h-1-y)  rotate 180
+//	4: (x, h-1-y)      flip vertical
+//	5: (y, x)          transpose
+//	6: (y, h-1-x)      rotate 90 clockwise
+//	7: (w-1-y, h-1-x)  transverse
+//	8: (w-1-y, x)      rotate 270 clockwise
+func orientPlane(dst, src plane, orientation int) {
+	size := src.size
+	parallelRows(dst.height, func(start, end int) {
+		for y := start; y < end; y++ {
+			row := dst.pix[y*dst.stride : y*dst.stride+dst.width*size]
+
+			if !transposes(orientation) {
+				sy := y
+				if orientation != 2 {
+					sy = src.height - 1 - y
+				}
+				srcRow := src.pix[sy*src.stride : sy*src.stride+src.width*size]
+				if orientation == 4 {
+					copy(row, srcRow)
+				} else {
+					reverseRow(row, srcRow, size)
+				}
+				continue
+			}
+
+			// A destination row is a source column, read top to bottom for
+			// 5 and 8 and bottom to top for 6 and 7
+			sx := y
+			if orientation == 7 || orientation == 8 {
+				sx = src.width - 1 - y
+			}
+			offset, step := sx*size, src.stride
+			if orientation == 6 || orientation == 7 {
+				offset, step = (src.height-1)*src.stride+sx*size, -src.stride
+			}
+			gatherColumn(row, src.pix, offset, step, size)
+		}
+	})
+}
+
+// reverseRow copies the pixels of src to dst in reverse order.
+func reverseRow(dst, src []byte, size int) {
+	n := len(src) / size
+	switch size {
+	case 1:
+		for x := 0; x < n; x++ {
+			dst[x] = src[n-1-x]
+		}
+	case 4:
+		for x := 0; x < n; x++ {
+			d, s := dst[x*4:x*4+4:x*4+4], src[(n-1-x)*4:(n-x)*4:(n-x)*4]
+			d[0], d[1], d[2], d[3] = s[0], s[1], s[2], s[3]
+		}
+	default:
+		for x := 0; x < n; x++ {
+			copy(dst[x*size:(x+1)*size], src[(n-1-x)*size:(n-x)*size])
+		}
+	}
+}
+
+// gatherColumn fills dst with pixels read from src starting at offset and
+// moving step bytes between them.
+func gatherColumn(dst, src []byte, offset, step, size int) {
+	n := len(dst) / size
+	switch size {
+	case 1:
+		for x := 0; x < n; x++ {
+			dst[x] = src[offset]
+			offset += step
+		}
+	case 4:
+		for x := 0; x < n; x++ {
+			d, s := dst[x*4:x*4+4:x*4+4], src[offset:offset+4:offset+4]
+			d[0], d[1], d[2], d[3] = s[0], s[1], s[2], s[3]
+			offset += step
+		}
+	default:
+		for x := 0; x < n; x++ {
+			copy(dst[x*size:(x+1)*size], src[offset:offset+size])
+			offset += step
+		}
+	}
+}
+
+// transposedRatio gives the chroma subsampling of a YCbCr image once its
+// axes are swapped. 4:1:1 and 4:1:0 have no transposed equivalent.
+var transposedRatio = map[image.YCbCrSubsampleRatio]image.YCbCrSubsampleRatio{
+	image.YCbCrSubsampleRatio444: image.YCbCrSubsampleRatio444,
+	image.YCbCrSubsampleRatio420: image.YCbCrSubsampleRatio420,
+	image.YCbCrSubsampleRatio422: image.YCbCrSubsampleRatio440,
+	image.YCbCrSubsampleRatio440: image.YCbCrSubsampleRatio422,
+}
+
+// orientYCbCr orients the luma and both chroma planes separately. It
+// reports false, leaving the image to be converted, when the subsampling
+// cannot be transposed or a subsampled dimension is odd or offset, as the
+// flipped chroma samples would then no longer line up with the luma.
+func orientYCbCr(src *image.YCbCr, orientation int) (*image.YCbCr, bool) {
+	ratio, ok := transposedRatio[src.SubsampleRatio]
+	if !ok {
+		return nil, false
+	}
+	if !transposes(orientation) {
+		ratio = src.SubsampleRatio
+	}
+
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	cw, ch := w, h
+	switch src.SubsampleRatio {
+	case image.YCbCrSubsampleRatio420:
+		cw, ch = w/2, h/2
+	case image.YCbCrSubsampleRatio422:
+		cw = w / 2
+	case image.YCbCrSubsampleRatio440:
+		ch = h / 2
+	}
+	if src.Rect.Min != (image.Point{}) || (cw != w && w%2 != 0) || (ch != h && h%2 != 0) {
+		return nil, false
+	}
+
+	dst := image.NewYCbCr(orientedRect(src.Rect, orientation), ratio)
+	chroma := image.Rect(0, 0, cw, ch)
+	orientedChroma := orientedRect(chroma, orientation)
+
+	orientPlane(pixelPlane(dst.Y, dst.YStride, dst.Rect, 1), pixelPlane(src.Y, src.YStride, src.Rect, 1), orientation)
+	orientPlane(pixelPlane(dst.Cb, dst.CStride, orientedChroma, 1), pixelPlane(src.Cb, src.CStride, chroma, 1), orientation)
+	orientPlane(pixelPlane(dst.Cr, dst.CStride, orientedChroma, 1), pixelPlane(src.Cr, src.CStride, chroma, 1), orientation)
+	return dst, true
+}
+
+// minBandRows keeps bands large enough that starting a goroutine is worth
+// it.
+const minBandRows = 64
+
+// parallelRows calls fn for consecutive bands of rows covering [0, rows),
+// one band per CPU, and waits for them all.
+func parallelRows(rows int, fn func(start, end int)) {
+	bands := min(runtime.GOMAXPROCS(0), rows/minBandRows)
+	if bands <= 1 {
+		fn(0, rows)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < bands; i++ {
+		start, end := rows*i/bands, rows*(i+1)/bands
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(start, end)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,166 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"image"
+	"math/rand/v2"
+	"testing"
+)
+
+// referenceOrientation applies an EXIF orientation pixel by pixel, moving
+// each source pixel (x, y) of a w x h image to where the orientation puts it.
+func referenceOrientation(img image.Image, orientation int) *image.RGBA64 {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dst := image.NewRGBA64(orientedRect(bounds, orientation))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 1:
+				dx, dy = x, y
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
+
+func randomYCbCr(r image.Rectangle, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	img := image.NewYCbCr(r, ratio)
+	fillRandom(img.Y, img.Cb, img.Cr)
+	return img
+}
+
+func randomRGBA(r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r)
+	fillRandom(img.Pix)
+	return img
+}
+
+func randomNRGBA(r image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(r)
+	fillRandom(img.Pix)
+	return img
+}
+
+func fillRandom(bufs ...[]byte) {
+	for _, buf := range bufs {
+		for i := range buf {
+			buf[i] = uint8(rand.Uint32())
+		}
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 7, 5))
+	fillRandom(gray.Pix)
+
+	images := []struct {
+		name string
+		img  image.Image
+	}{
+		{"ycbcr 4:2:0", randomYCbCr(image.Rect(0, 0, 12, 8), image.YCbCrSubsampleRatio420)},
+		{"ycbcr 4:2:2", randomYCbCr(image.Rect(0, 0, 12, 8), image.YCbCrSubsampleRatio422)},
+		{"ycbcr 4:4:0", randomYCbCr(image.Rect(0, 0, 12, 8), image.YCbCrSubsampleRatio440)},
+		{"ycbcr 4:4:4", randomYCbCr(image.Rect(0, 0, 7, 5), image.YCbCrSubsampleRatio444)},
+		{"ycbcr odd size", randomYCbCr(image.Rect(0, 0, 7, 5), image.YCbCrSubsampleRatio420)},
+		{"ycbcr 4:1:1", randomYCbCr(image.Rect(0, 0, 12, 8), image.YCbCrSubsampleRatio411)},
+		{"rgba", randomRGBA(image.Rect(0, 0, 7, 5))},
+		{"rgba offset", randomRGBA(image.Rect(0, 0, 20, 20)).SubImage(image.Rect(3, 4, 10, 9))},
+		{"nrgba", randomNRGBA(image.Rect(0, 0, 7, 5))},
+		{"gray", gray},
+	}
+	for _, source := range images {
+		for orientation := 1; orientation <= 8; orientation++ {
+			t.Run(fmt.Sprintf("%s/%d", source.name, orientation), func(t *testing.T) {
+				want := referenceOrientation(source.img, orientation)
+				got := ApplyOrientation(source.img, orientation)
+				if got.Bounds().Size() != want.Bounds().Size() {
+					t.Fatalf("size = %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+				}
+				// Images converted to RGBA first keep 8 bits per channel
+				origin := got.Bounds().Min
+				for y := 0; y < want.Rect.Dy(); y++ {
+					for x := 0; x < want.Rect.Dx(); x++ {
+						r, g, b, a := got.At(origin.X+x, origin.Y+y).RGBA()
+						if c := want.RGBA64At(x, y); c.R>>8 != uint16(r>>8) || c.G>>8 != uint16(g>>8) || c.B>>8 != uint16(b>>8) || c.A>>8 != uint16(a>>8) {
+							t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got.At(origin.X+x, origin.Y+y), c)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestApplyOrientationKeepsType(t *testing.T) {
+	src := randomYCbCr(image.Rect(0, 0, 12, 8), image.YCbCrSubsampleRatio422)
+	got, ok := ApplyOrientation(src, 6).(*image.YCbCr)
+	if !ok {
+		t.Fatalf("got %T, want *image.YCbCr", ApplyOrientation(src, 6))
+	}
+	if got.SubsampleRatio != image.YCbCrSubsampleRatio440 {
+		t.Errorf("subsampling = %v, want 4:4:0", got.SubsampleRatio)
+	}
+	if _, ok := ApplyOrientation(randomNRGBA(image.Rect(0, 0, 4, 4)), 3).(*image.NRGBA); !ok {
+		t.Error("NRGBA image was converted")
+	}
+}
+
+// benchmarkImages are 12 megapixel photos of the pixel types decoders
+// return.
+func benchmarkImages() []struct {
+	name string
+	img  image.Image
+} {
+	r := image.Rect(0, 0, 4032, 3024)
+	return []struct {
+		name string
+		img  image.Image
+	}{
+		{"ycbcr", randomYCbCr(r, image.YCbCrSubsampleRatio420)},
+		{"rgba", randomRGBA(r)},
+		{"nrgba", randomNRGBA(r)},
+	}
+}
+
+func BenchmarkApplyOrientation(b *testing.B) {
+	for _, source := range benchmarkImages() {
+		for orientation := 2; orientation <= 8; orientation++ {
+			b.Run(fmt.Sprintf("%s/%d", source.name, orientation), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					ApplyOrientation(source.img, orientation)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkReferenceOrientation times the per-pixel transform as a baseline
+// for BenchmarkApplyOrientation.
+func BenchmarkReferenceOrientation(b *testing.B) {
+	for _, source := range benchmarkImages() {
+		for orientation := 2; orientation <= 8; orientation++ {
+			b.Run(fmt.Sprintf("%s/%d", source.name, orientation), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					referenceOrientation(source.img, orientation)
+				}
+			})
+		}
+	}
+}
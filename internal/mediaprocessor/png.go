@@ -0,0 +1,242 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image/png"
+	"io"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+var errNotPNG = errors.New("not a PNG file")
+
+// pngChunk is a single chunk of a PNG file.
+type pngChunk struct {
+	typ  string
+	data []byte
+	// raw is the chunk exactly as it appeared in the file, including the
+	// length, type and CRC fields.
+	raw []byte
+}
+
+// scanPNG splits data into its chunks, stopping after IEND.
+func scanPNG(data []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errNotPNG
+	}
+
+	var chunks []pngChunk
+	pos := len(pngSignature)
+	for pos+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		end := pos + 12 + length
+		if length < 0 || end > len(data) || end < pos {
+			return nil, fmt.Errorf("invalid PNG chunk length at offset %d", pos)
+		}
+		chunk := pngChunk{
+			typ:  string(data[pos+4 : pos+8]),
+			data: data[pos+8 : pos+8+length],
+			raw:  data[pos:end],
+		}
+		chunks = append(chunks, chunk)
+		pos = end
+		if chunk.typ == "IEND" {
+			return chunks, nil
+		}
+	}
+
+	return nil, errors.New("PNG has no IEND chunk")
+}
+
+// critical reports whether the chunk is required to render the image.
+// Ancillary chunks have a lowercase first letter.
+func (c pngChunk) critical() bool {
+	return c.typ[0]&0x20 == 0
+}
+
+// appendPNGChunk appends a chunk with a freshly computed CRC to dst.
+func appendPNGChunk(dst []byte, typ string, data []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)))
+	start := len(dst)
+	dst = append(dst, typ...)
+	dst = append(dst, data...)
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(dst[start:]))
+}
+
+// PNGProcessor strips metadata from PNG files chunk by chunk, keeping the
+// image data and transparency byte for byte. Images whose eXIf orientation
+// is not 1 are re-encoded upright unless Options.Orientation is
+// OrientationTag, as are images with a redaction or fingerprint mitigation.
+type PNGProcessor struct{}
+
+// Process implements Processor.
+func (PNGProcessor) Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	if opts.ConvertPNG {
+		return convertToJpg(ctx, r, w, png.Decode, opts)
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("error reading input: %w", err)
+	}
+
+	if err := opts.Limits.checkImage(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	chunks, err := scanPNG(data)
+	if err != nil {
+		return decodeError(fmt.Errorf("error reading PNG chunks: %w", err))
+	}
+
+	source := &exifData{order: binary.BigEndian}
+	for _, c := range chunks {
+		if c.typ == "eXIf" {
+			if parsed, err := parseEXIF(c.data); err == nil {
+				source = parsed
+			}
+			break
+		}
+	}
+
+	orientation := source.orientation()
+	if (orientation != 1 && opts.Orientation != OrientationTag) || opts.reencodesImages() {
+		return reencodePNG(ctx, data, chunks, w, orientation, opts)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	kept := source.filter(opts.Policy)
+	if orientation != 1 {
+		kept.setOrientation(orientation)
+	}
+
+	out := stripPNGChunks(chunks, kept, opts.Policy)
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
+	return nil
+}
+
+// OutputExt implements FormatChanger.
+func (PNGProcessor) OutputExt(opts Options) string {
+	if opts.ConvertPNG {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// Inspect implements Inspector.
+func (PNGProcessor) Inspect(ctx context.Context, r io.Reader) (*Report, error) {
+	return ImageProcessor{}.Inspect(ctx, r)
+}
+
+// stripPNGChunks reassembles a PNG from its critical chunks and the
+// ancillary chunks that affect rendering, writing kept as the only eXIf
+// chunk. Text, timestamps, physical dimensions and unknown ancillary chunks
+// are dropped. The ICC profile survives if the policy keeps it.
+func stripPNGChunks(chunks []pngChunk, kept *exifData, policy Policy) []byte {
+	out := append([]byte(nil), pngSignature...)
+	for _, c := range chunks {
+		switch {
+		case c.typ == "iCCP":
+			if policy.Keeps(GroupICCProfile) {
+				out = append(out, c.raw...)
+			}
+		case c.critical() || pngRenderingChunks[c.typ]:
+			// eXIf must precede the image data
+			if c.typ == "IDAT" && len(kept.entries) > 0 {
+				out = appendPNGChunk(out, "eXIf", bytes.TrimPrefix(kept.encode(), jpegExifID))
+				kept = &exifData{}
+			}
+			out = append(out, c.raw...)
+		}
+	}
+	return out
+}
+
+// reencodePNG decodes the image, applies the orientation, redaction and
+// fingerprint mitigation and encodes it as a new PNG. Of the ancillary
+// chunks of the source, only those describing its colour space are kept.
+func reencodePNG(ctx context.Context, data []byte, chunks []pngChunk, w io.Writer, orientation int, opts Options) error {
+	if err := opts.Limits.checkImage(bytes.NewReader(data)); err != nil {
+		return err
+	}
+
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return decodeError(fmt.Errorf("error decoding image: %w", err))
+	}
+
+	img = ApplyOrientation(img, orientation)
+
+	img, err = finishImage(ctx, img, opts)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var encoded bytes.Buffer
+	err = png.Encode(&encoded, img)
+	if err != nil {
+		return fmt.Errorf("error encoding PNG: %w", err)
+	}
+	out, err := insertPNGColourChunks(encoded.Bytes(), chunks, opts.Policy)
+	if err != nil {
+		return fmt.Errorf("error encoding PNG: %w", err)
+	}
+	if _, err := w.Write(out); err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
+	return nil
+}
+
+// pngColourChunks are the ancillary chunks describing the colour space of
+// an image, which still hold once its pixels are encoded again.
+var pngColourChunks = map[string]bool{
+	"iCCP": true,
+	"sRGB": true,
+	"gAMA": true,
+	"cHRM": true,
+	"cICP": true,
+}
+
+// insertPNGColourChunks copies the colour space chunks of source into
+// encoded, right after its IHDR chunk. The ICC profile is copied if the
+// policy keeps it and the image is still gray or still in colour, as the
+// profile must match.
+func insertPNGColourChunks(encoded []byte, source []pngChunk, policy Policy) ([]byte, error) {
+	chunks, err := scanPNG(encoded)
+	if err != nil {
+		return nil, err
+	}
+	ihdr := chunks[0]
+	head := len(pngSignature) + len(ihdr.raw)
+
+	out := append([]byte(nil), encoded[:head]...)
+	for _, c := range source {
+		if !pngColourChunks[c.typ] {
+			continue
+		}
+		if c.typ == "iCCP" && (!policy.Keeps(GroupICCProfile) || grayPNG(source[0]) != grayPNG(ihdr)) {
+			continue
+		}
+		out = append(out, c.raw...)
+	}
+	return append(out, encoded[head:]...), nil
+}
+
+// grayPNG reports whether an IHDR chunk declares a grayscale image.
+func grayPNG(ihdr pngChunk) bool {
+	return len(ihdr.data) > 9 && ihdr.data[9]&2 == 0
+}
@@ -0,0 +1,214 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// testPNG encodes a paletted image with a transparent colour, which gives
+// it PLTE and tRNS chunks, and inserts the given chunks after IHDR.
+func testPNG(t *testing.T, extra ...pngChunk) []byte {
+	t.Helper()
+	palette := color.Palette{color.RGBA{0, 0, 0, 0}, color.RGBA{255, 0, 0, 255}, color.RGBA{0, 0, 255, 255}}
+	img := image.NewPaletted(image.Rect(0, 0, 8, 8), palette)
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 3)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := scanPNG(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := append([]byte(nil), pngSignature...)
+	for _, c := range chunks {
+		out = append(out, c.raw...)
+		if c.typ == "IHDR" {
+			for _, e := range extra {
+				out = appendPNGChunk(out, e.typ, e.data)
+			}
+		}
+	}
+	return out
+}
+
+func processPNG(t *testing.T, data []byte, opts Options) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := (PNGProcessor{}).Process(context.Background(), bytes.NewReader(data), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+// pngChunkTypes returns the chunk types of data in order, failing the test
+// if any chunk has a bad CRC.
+func pngChunkTypes(t *testing.T, data []byte) []string {
+	t.Helper()
+	chunks, err := scanPNG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, c := range chunks {
+		crc := binary.BigEndian.Uint32(c.raw[len(c.raw)-4:])
+		if want := crc32.ChecksumIEEE(c.raw[4 : len(c.raw)-4]); crc != want {
+			t.Errorf("%s chunk CRC = %08x, want %08x", c.typ, crc, want)
+		}
+		types = append(types, c.typ)
+	}
+	return types
+}
+
+func TestPNGStripChunks(t *testing.T) {
+	exif := bytes.TrimPrefix(testEXIF(1, "Canon"), jpegExifID)
+	data := testPNG(t,
+		pngChunk{typ: "tEXt", data: []byte("Author\x00Someone")},
+		pngChunk{typ: "zTXt", data: []byte("Comment\x00\x00x\x9c\x03\x00\x00\x00\x00\x01")},
+		pngChunk{typ: "iTXt", data: []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>")},
+		pngChunk{typ: "eXIf", data: exif},
+		pngChunk{typ: "tIME", data: []byte{0x07, 0xE8, 1, 2, 3, 4, 5}},
+		pngChunk{typ: "pHYs", data: []byte{0, 0, 0x0B, 0x13, 0, 0, 0x0B, 0x13, 1}},
+		pngChunk{typ: "vpAg", data: []byte{0, 0, 0, 8, 0, 0, 0, 8, 0}},
+		pngChunk{typ: "iCCP", data: []byte("Profile\x00\x00x\x9c\x03\x00\x00\x00\x00\x01")},
+		pngChunk{typ: "gAMA", data: []byte{0, 0, 0xB1, 0x8F}},
+	)
+
+	tests := []struct {
+		name   string
+		policy Policy
+		types  []string
+	}{
+		{"strip all", Policy{}, []string{"IHDR", "gAMA", "PLTE", "tRNS", "IDAT", "IEND"}},
+		{"keep ICC", Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupICCProfile}}, []string{"IHDR", "iCCP", "gAMA", "PLTE", "tRNS", "IDAT", "IEND"}},
+		{"keep camera", Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupCamera}}, []string{"IHDR", "gAMA", "PLTE", "tRNS", "eXIf", "IDAT", "IEND"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := processPNG(t, data, Options{Policy: tt.policy})
+			if got := pngChunkTypes(t, out); !reflect.DeepEqual(got, tt.types) {
+				t.Errorf("chunks = %v, want %v", got, tt.types)
+			}
+
+			// Critical chunks and transparency are copied byte for byte
+			in, _ := scanPNG(data)
+			kept, _ := scanPNG(out)
+			for _, c := range in {
+				if !c.critical() && c.typ != "tRNS" {
+					continue
+				}
+				found := false
+				for _, k := range kept {
+					found = found || bytes.Equal(k.raw, c.raw)
+				}
+				if !found {
+					t.Errorf("%s chunk changed or missing", c.typ)
+				}
+			}
+
+			for _, c := range kept {
+				if c.typ != "eXIf" {
+					continue
+				}
+				e, err := parseEXIF(c.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(e.entries) != 1 || e.entries[0].tag != 0x010F {
+					t.Errorf("retained EXIF = %+v, want the make only", e.entries)
+				}
+			}
+
+			if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+				t.Errorf("output does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestPNGOrientationTag(t *testing.T) {
+	exif := bytes.TrimPrefix(testEXIF(6, "Canon"), jpegExifID)
+	data := testPNG(t, pngChunk{typ: "eXIf", data: exif})
+	out := processPNG(t, data, Options{Orientation: OrientationTag})
+
+	chunks, err := scanPNG(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, c := range chunks {
+		if c.typ != "eXIf" {
+			continue
+		}
+		found = true
+		e, err := parseEXIF(c.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.entries) != 1 || e.orientation() != 6 {
+			t.Errorf("retained EXIF = %+v, want orientation 6 only", e.entries)
+		}
+	}
+	if !found {
+		t.Error("no eXIf chunk, want one holding the orientation")
+	}
+}
+
+func TestPNGReencodeKeepsColourSpace(t *testing.T) {
+	exif := bytes.TrimPrefix(testEXIF(6, "Canon"), jpegExifID)
+	iccp := pngChunk{typ: "iCCP", data: []byte("Profile\x00\x00x\x9c\x03\x00\x00\x00\x00\x01")}
+	data := testPNG(t,
+		iccp,
+		pngChunk{typ: "gAMA", data: []byte{0, 0, 0xB1, 0x8F}},
+		pngChunk{typ: "tEXt", data: []byte("Author\x00Someone")},
+		pngChunk{typ: "eXIf", data: exif},
+	)
+
+	tests := []struct {
+		name   string
+		policy Policy
+		types  []string
+	}{
+		{"strip all", Policy{}, []string{"IHDR", "gAMA", "IDAT", "IEND"}},
+		{"keep ICC", Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupICCProfile}}, []string{"IHDR", "iCCP", "gAMA", "IDAT", "IEND"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := processPNG(t, data, Options{Policy: tt.policy})
+			if got := pngChunkTypes(t, out); !reflect.DeepEqual(got, tt.types) {
+				t.Errorf("chunks = %v, want %v", got, tt.types)
+			}
+			chunks, _ := scanPNG(out)
+			for _, c := range chunks {
+				if c.typ == "iCCP" && !bytes.Equal(c.data, iccp.data) {
+					t.Errorf("ICC profile = %q, want %q", c.data, iccp.data)
+				}
+			}
+
+			// Turned upright by the re-encode
+			img, err := png.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("output does not decode: %v", err)
+			}
+			src, _ := png.Decode(bytes.NewReader(data))
+			want := referenceOrientation(src, 6)
+			for y := 0; y < 8; y++ {
+				for x := 0; x < 8; x++ {
+					if r, g, b, a := img.At(x, y).RGBA(); want.RGBA64At(x, y) != (color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}) {
+						t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, img.At(x, y), want.RGBA64At(x, y))
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package mediaprocessor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TagGroup names a family of metadata fields that a Policy keeps or removes.
+type TagGroup string
+
+const (
+	GroupCaptureDate TagGroup = "capture-date" // Original, digitized and modified timestamps
+	GroupCopyright   TagGroup = "copyright"    // Copyright notice and artist
+	GroupDescription TagGroup = "description"  // Title, description and comments
+	GroupCamera      TagGroup = "camera"       // Camera and lens make and model
+	GroupExposure    TagGroup = "exposure"     // Exposure, aperture, ISO and focal length
+	GroupSoftware    TagGroup = "software"     // Software that created or edited the file
+	GroupICCProfile  TagGroup = "icc-profile"  // Embedded colour profile
+	GroupGPS         TagGroup = "gps"          // Location, always removed
+	GroupSerial      TagGroup = "serial"       // Body and lens serial numbers and unique IDs, always removed
+	GroupOwner       TagGroup = "owner"        // Camera owner name, always removed
+)
+
+// AllTagGroups lists every known tag group.
+var AllTagGroups = []TagGroup{
+	GroupCaptureDate,
+	GroupCopyright,
+	GroupDescription,
+	GroupCamera,
+	GroupExposure,
+	GroupSoftware,
+	GroupICCProfile,
+	GroupGPS,
+	GroupSerial,
+	GroupOwner,
+}
+
+// alwaysRemoved are the groups no policy can retain.
+var alwaysRemoved = map[TagGroup]bool{
+	GroupGPS:    true,
+	GroupSerial: true,
+	GroupOwner:  true,
+}
+
+// PolicyMode selects how a Policy interprets its group list.
+type PolicyMode string
+
+const (
+	// PolicyAllow keeps only the listed groups.
+	PolicyAllow PolicyMode = "allow"
+	// PolicyDeny keeps every group except the listed ones.
+	PolicyDeny PolicyMode = "deny"
+)
+
+// Policy decides which groups of metadata survive scrubbing. Metadata that
+// does not belong to any group, such as maker notes, is always removed, as
+// are GPS, serial numbers and owner names. The zero Policy removes
+// everything.
+type Policy struct {
+	Mode   PolicyMode `json:"mode"`
+	Groups []TagGroup `json:"groups,omitempty"`
+}
+
+// Keeps reports whether metadata in group g is retained.
+func (p Policy) Keeps(g TagGroup) bool {
+	if alwaysRemoved[g] {
+		return false
+	}
+	listed := false
+	for _, group := range p.Groups {
+		if group == g {
+			listed = true
+			break
+		}
+	}
+	if p.Mode == PolicyDeny {
+		return !listed
+	}
+	return listed
+}
+
+// KeepsAny reports whether the policy retains any metadata at all.
+func (p Policy) KeepsAny() bool {
+	for _, g := range AllTagGroups {
+		if p.Keeps(g) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that the mode and all groups are known.
+func (p Policy) Validate() error {
+	switch p.Mode {
+	case "", PolicyAllow, PolicyDeny:
+	default:
+		return fmt.Errorf("unknown policy mode %q", p.Mode)
+	}
+	for _, g := range p.Groups {
+		if !isTagGroup(g) {
+			return fmt.Errorf("unknown tag group %q", g)
+		}
+	}
+	return nil
+}
+
+func isTagGroup(g TagGroup) bool {
+	for _, group := range AllTagGroups {
+		if group == g {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the policy in the syntax accepted by ParsePolicy.
+func (p Policy) String() string {
+	if !p.KeepsAny() {
+		return "strip-all"
+	}
+	mode := p.Mode
+	if mode == "" {
+		mode = PolicyAllow
+	}
+	groups := make([]string, len(p.Groups))
+	for i, g := range p.Groups {
+		groups[i] = string(g)
+	}
+	sort.Strings(groups)
+	return fmt.Sprintf("%s:%s", mode, strings.Join(groups, ","))
+}
+
+// ParsePolicy parses a policy written either as JSON, such as
+// {"mode":"allow","groups":["capture-date"]}, or in the short form
+// "allow:capture-date,copyright" or "deny:camera". An empty string or
+// "strip-all" removes everything.
+func ParsePolicy(s string) (Policy, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "strip-all" {
+		return Policy{}, nil
+	}
+
+	var p Policy
+	if strings.HasPrefix(s, "{") {
+		if err := json.Unmarshal([]byte(s), &p); err != nil {
+			return Policy{}, fmt.Errorf("invalid policy JSON: %w", err)
+		}
+	} else {
+		mode, list, found := strings.Cut(s, ":")
+		if !found {
+			return Policy{}, fmt.Errorf("invalid policy %q: expected allow:<groups> or deny:<groups>", s)
+		}
+		p.Mode = PolicyMode(strings.TrimSpace(mode))
+		for _, g := range strings.Split(list, ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				p.Groups = append(p.Groups, TagGroup(g))
+			}
+		}
+	}
+
+	if err := p.Validate(); err != nil {
+		return Policy{}, err
+	}
+	return p, nil
+}
+
+// retainedJPEGSegments builds the APP1 (EXIF) and APP2 (ICC) segments that
+// carry the metadata the policy keeps from the source image data.
+func retainedJPEGSegments(data []byte, policy Policy) ([]byte, error) {
+	var segments []byte
+
+	if raw := extractEXIF(data); raw != nil {
+		if parsed, err := parseEXIF(raw); err == nil {
+			if kept := parsed.filter(policy); len(kept.entries) > 0 {
+				segments, err = appendJPEGSegment(segments, markerAPP1, kept.encode())
+				if err != nil {
+					return nil, fmt.Errorf("error writing retained EXIF: %w", err)
+				}
+			}
+		}
+	}
+
+	if policy.Keeps(GroupICCProfile) {
+		if profile := extractICC(data); profile != nil {
+			for _, payload := range iccSegments(profile) {
+				var err error
+				segments, err = appendJPEGSegment(segments, markerAPP2, payload)
+				if err != nil {
+					return nil, fmt.Errorf("error writing ICC profile: %w", err)
+				}
+			}
+		}
+	}
+
+	return segments, nil
+}
+
+// videoTagGroups assigns container tags, as named by FFmpeg, to the policy
+// groups that govern them. Tags not listed here are never retained.
+var videoTagGroups = map[string]TagGroup{
+	"creation_time":                        GroupCaptureDate,
+	"date":                                 GroupCaptureDate,
+	"com.apple.quicktime.creationdate":     GroupCaptureDate,
+	"copyright":                            GroupCopyright,
+	"artist":                               GroupCopyright,
+	"com.apple.quicktime.copyright":        GroupCopyright,
+	"com.apple.quicktime.artist":           GroupCopyright,
+	"title":                                GroupDescription,
+	"description":                          GroupDescription,
+	"comment":                              GroupDescription,
+	"com.apple.quicktime.title":            GroupDescription,
+	"com.apple.quicktime.description":      GroupDescription,
+	"com.apple.quicktime.comment":          GroupDescription,
+	"make":                                 GroupCamera,
+	"model":                                GroupCamera,
+	"com.apple.quicktime.make":             GroupCamera,
+	"com.apple.quicktime.model":            GroupCamera,
+	"software":                             GroupSoftware,
+	"com.apple.quicktime.software":         GroupSoftware,
+	"location":                             GroupGPS,
+	"location-eng":                         GroupGPS,
+	"com.apple.quicktime.location.iso6709": GroupGPS,
+}
+
+// retainedVideoTags returns FFmpeg -metadata arguments restoring the
+// container tags of the probed source that the policy keeps.
+func retainedVideoTags(probed *probeResult, policy Policy) []string {
+	keys := make([]string, 0, len(probed.Format.Tags))
+	for key := range probed.Format.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var args []string
+	for _, key := range keys {
+		group, known := videoTagGroups[strings.ToLower(key)]
+		if known && policy.Keeps(group) {
+			args = append(args, "-metadata", fmt.Sprintf("%s=%s", key, probed.Format.Tags[key]))
+		}
+	}
+	return args
+}
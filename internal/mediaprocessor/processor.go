@@ -1,258 +1,754 @@
 package mediaprocessor
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"image"
 	"image/jpeg"
-	"image/png"
+	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/adrium/goheif"
 	"github.com/evanoberholster/imagemeta"
-	"golang.org/x/image/draw"
-	"golang.org/x/image/math/f64"
 )
 
 // fileCounter is used to generate ordered prefixes for filenames
 var fileCounter uint64
 
-// SupportedExtensions maps file extensions to their processing functions.
-// Extensions are lowercase - callers should normalize with strings.ToLower().
-var SupportedExtensions = map[string]func(string, string) error{
-	".heic": convertToJpg,
-	".jpg":  convertToJpg,
-	".jpeg": convertToJpg,
-	".png":  convertToJpg,
-	".mov":  convertMovToMp4,
-	".mp4":  convertMovToMp4,
+// DefaultJPEGQuality is the quality used when Options.JPEGQuality is unset.
+const DefaultJPEGQuality = 90
+
+// Options configures how a Processor scrubs a single file.
+type Options struct {
+	// JPEGQuality is the quality used when re-encoding images (1-100).
+	// Zero means DefaultJPEGQuality.
+	JPEGQuality int
+
+	// ConvertPNG re-encodes PNG inputs as JPEG instead of keeping them as
+	// PNG.
+	ConvertPNG bool
+
+	// Orientation controls how JPEGs and PNGs with an EXIF orientation
+	// other than 1 are scrubbed. The zero value means OrientationBake.
+	Orientation OrientationMode
+
+	// Redaction hides regions of images and videos before they are
+	// encoded. Images with a redaction are always decoded, re-encoded and
+	// turned upright, whatever the Orientation mode; videos are transcoded
+	// with Profile, or ProfileH264 if it is nil. Nil leaves the pixels
+	// untouched.
+	Redaction *Redaction
+
+	// AntiFingerprint, from 0 to 1, weakens the sensor noise pattern that
+	// can tie a photo to the camera that took it: images are randomly
+	// cropped and resampled slightly, given mild noise and re-quantized
+	// before encoding. Higher values hide more and cost more quality. Zero
+	// turns it off; otherwise, like Redaction, it forces images to be
+	// re-encoded.
+	AntiFingerprint float64
+
+	// Profile re-encodes videos with FFmpeg. Nil removes their metadata
+	// boxes in place instead.
+	Profile *Profile
+
+	// Policy selects which metadata survives scrubbing. The zero value
+	// removes everything.
+	Policy Policy
+
+	// SkipVerify turns off the check that parses every output again and
+	// fails if metadata the policy does not keep is still there. Verifying
+	// videos needs FFprobe.
+	SkipVerify bool
+
+	// TrackDropped, if set, is called for every track a video processor
+	// removes, before it writes any output.
+	TrackDropped func(track DroppedTrack)
+
+	// Scratch, if set, tracks the temporary files processing creates, so
+	// that they are wiped with the rest of the job's files when it closes.
+	// Nil wipes each of them once it is no longer needed.
+	Scratch *ScratchJob
+
+	// Progress, if set, is called with the percentage of the file processed
+	// so far. Video processing reports as it goes; other processors only
+	// report completion. It is called from the goroutine doing the work.
+	Progress func(percent float64)
+
+	// Limits bounds the size of the files processed. The zero value sets
+	// no limits; servers should use DefaultLimits or stricter.
+	Limits Limits
+
+	// Timeout bounds how long a single file may take to process. Zero means
+	// no limit beyond the caller's context.
+	Timeout time.Duration
 }
 
-// ProcessLocalMediaFile handles the processing of a single media file
-func ProcessLocalMediaFile(inputPath, outputPath string) error {
-	ext := strings.ToLower(filepath.Ext(inputPath))
+func (o Options) jpegQuality() int {
+	if o.JPEGQuality <= 0 || o.JPEGQuality > 100 {
+		return DefaultJPEGQuality
+	}
+	return o.JPEGQuality
+}
+
+// videoProfile returns the profile videos are transcoded with, or nil if
+// they are scrubbed in place.
+func (o Options) videoProfile() *Profile {
+	if o.Profile == nil && o.Redaction != nil {
+		// Redacting needs the frames decoded and encoded again
+		return &ProfileH264
+	}
+	return o.Profile
+}
+
+// scratch returns the job temporary files are created in. Without one, each
+// file is wiped by the Remove its creator defers.
+func (o Options) scratch() *ScratchJob {
+	if o.Scratch != nil {
+		return o.Scratch
+	}
+	return DefaultScratch.NewJob()
+}
+
+// withTimeout derives the per-file context from ctx.
+func (o Options) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o.Timeout > 0 {
+		return context.WithTimeout(ctx, o.Timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// OrientationMode selects how lossless JPEG scrubbing handles orientation.
+type OrientationMode string
+
+const (
+	// OrientationBake rotates the pixels when the orientation is not 1,
+	// which requires re-encoding. Upright images are still rewritten
+	// losslessly.
+	OrientationBake OrientationMode = "bake"
+	// OrientationTag never re-encodes and keeps the orientation as the only
+	// EXIF tag, beyond those the policy retains.
+	OrientationTag OrientationMode = "tag"
+)
+
+// ParseOrientationMode parses "bake" or "tag". An empty string means
+// OrientationBake.
+func ParseOrientationMode(s string) (OrientationMode, error) {
+	switch mode := OrientationMode(strings.TrimSpace(s)); mode {
+	case "", OrientationBake:
+		return OrientationBake, nil
+	case OrientationTag:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown orientation mode %q", s)
+	}
+}
+
+// Processor scrubs metadata from the media read from r and writes the
+// cleaned result to w. Implementations should stop early and return the
+// context's error once ctx is done.
+type Processor interface {
+	Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) error
+}
+
+// FormatChanger is implemented by processors that write a different format
+// than the one they read. Processors that do not implement it are assumed to
+// keep the input's extension.
+type FormatChanger interface {
+	// OutputExt returns the extension, with a leading dot, of the files
+	// Process writes with opts, or "" if they keep the input's format.
+	OutputExt(opts Options) string
+}
+
+// ProcessorFunc adapts an ordinary function to the Processor interface.
+type ProcessorFunc func(ctx context.Context, r io.Reader, w io.Writer, opts Options) error
+
+// Process calls f(ctx, r, w, opts).
+func (f ProcessorFunc) Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	return f(ctx, r, w, opts)
+}
+
+// Registry maps file extensions to the Processor that handles them.
+// It is safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	processors map[string]Processor
+}
 
-	processFunc, supported := SupportedExtensions[ext]
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{processors: make(map[string]Processor)}
+}
+
+// Register associates ext with p, replacing any existing processor.
+// The extension is normalized to lowercase with a leading dot.
+func (reg *Registry) Register(ext string, p Processor) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.processors[normalizeExt(ext)] = p
+}
+
+// Lookup returns the processor registered for ext.
+func (reg *Registry) Lookup(ext string) (Processor, bool) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	p, ok := reg.processors[normalizeExt(ext)]
+	return p, ok
+}
+
+// Extensions returns the registered extensions in sorted order.
+func (reg *Registry) Extensions() []string {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	exts := make([]string, 0, len(reg.processors))
+	for ext := range reg.processors {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+func normalizeExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// DefaultRegistry holds the built-in processors. Callers can add their own
+// formats with Register.
+var DefaultRegistry = newDefaultRegistry()
+
+func newDefaultRegistry() *Registry {
+	reg := NewRegistry()
+	reg.Register(".heic", ImageProcessor{Decode: goheif.Decode})
+	reg.Register(".jpg", JPEGProcessor{})
+	reg.Register(".jpeg", JPEGProcessor{})
+	reg.Register(".png", PNGProcessor{})
+	reg.Register(".mov", VideoProcessor{})
+	reg.Register(".mp4", VideoProcessor{})
+	reg.Register(".m4a", VideoProcessor{})
+	return reg
+}
+
+// Register adds a processor for ext to DefaultRegistry.
+func Register(ext string, p Processor) {
+	DefaultRegistry.Register(ext, p)
+}
+
+// OutputExt returns the extension of the file produced when processing an
+// input with extension ext.
+func OutputExt(ext string, opts Options) string {
+	processor, supported := DefaultRegistry.Lookup(ext)
+	if changer, ok := processor.(FormatChanger); supported && ok {
+		if outputExt := changer.OutputExt(opts); outputExt != "" {
+			return outputExt
+		}
+	}
+	return normalizeExt(ext)
+}
+
+// Process scrubs the media read from r using the processor registered in
+// DefaultRegistry for its format and writes the result to w. The format is
+// detected from the content, falling back to ext, the extension of the file
+// name, when the content is not recognized; see ResolveExt.
+func Process(ctx context.Context, r io.Reader, w io.Writer, ext string, opts Options) error {
+	ext, mismatch, r, err := sniff(r, ext)
+	if err != nil {
+		return err
+	}
+	processor, supported := DefaultRegistry.Lookup(ext)
 	if !supported {
-		return fmt.Errorf("unsupported file type: %s", ext)
+		return unsupportedError(ext, mismatch)
 	}
 
-	err := processFunc(inputPath, outputPath)
+	r, err = opts.Limits.limitInput(r)
 	if err != nil {
-		return fmt.Errorf("error processing file: %v", err)
+		return err
 	}
 
-	fmt.Printf("Processed %s to %s\n", inputPath, outputPath)
+	ctx, cancel := opts.withTimeout(ctx)
+	defer cancel()
+
+	if opts.SkipVerify {
+		err = processor.Process(ctx, r, w, opts)
+	} else {
+		err = processVerified(ctx, processor, r, w, OutputExt(ext, opts), opts)
+	}
+	if lr, ok := r.(*limitedReader); ok && lr.err != nil {
+		return lr.err
+	}
+	if err != nil {
+		return err
+	}
+	opts.reportProgress(100)
 	return nil
 }
 
-// convertToJpg converts a file to JPG without preserving metadata but maintaining orientation
-func convertToJpg(input, output string) error {
-	fileInput, err := os.Open(input)
+// processVerified processes r into a temporary file and copies it to w only
+// once it has been verified.
+func processVerified(ctx context.Context, processor Processor, r io.Reader, w io.Writer, outputExt string, opts Options) error {
+	scratch := opts.scratch()
+	tempOutput, err := scratch.CreateTemp("scrub-verify-*" + outputExt)
+	if err != nil {
+		return fmt.Errorf("error creating temporary output file: %w", err)
+	}
+	defer scratch.Remove(tempOutput)
+
+	err = processor.Process(ctx, r, tempOutput, opts)
 	if err != nil {
-		return fmt.Errorf("error opening input file: %v", err)
+		return err
+	}
+
+	err = verifyOutput(ctx, tempOutput.Name(), opts.Policy)
+	if err != nil {
+		return err
+	}
+
+	_, err = tempOutput.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = copyOut(w, tempOutput)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
+	return nil
+}
+
+// ProcessLocalMediaFile handles the processing of a single media file. Like
+// Process, it picks the processor by the detected format of the file.
+func ProcessLocalMediaFile(ctx context.Context, inputPath, outputPath string, opts Options) error {
+	fileInput, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("error opening input file: %w", err)
 	}
 	defer fileInput.Close()
 
+	ext, mismatch, err := ResolveExt(fileInput, filepath.Ext(inputPath))
+	if err != nil {
+		return err
+	}
+	processor, supported := DefaultRegistry.Lookup(ext)
+	if !supported {
+		return unsupportedError(ext, mismatch)
+	}
+
+	if _, err := opts.Limits.limitInput(fileInput); err != nil {
+		return err
+	}
+
+	fileOutput, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+
+	ctx, cancel := opts.withTimeout(ctx)
+	defer cancel()
+
+	err = processor.Process(ctx, fileInput, fileOutput, opts)
+	if closeErr := fileOutput.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+		return fmt.Errorf("error processing file: %w", err)
+	}
+
+	if !opts.SkipVerify {
+		err = verifyOutput(ctx, outputPath, opts.Policy)
+		if err != nil {
+			os.Remove(outputPath)
+			return err
+		}
+	}
+	opts.reportProgress(100)
+
+	fmt.Printf("Processed %s to %s\n", inputPath, outputPath)
+	return nil
+}
+
+// ImageProcessor re-encodes an image as JPG without preserving metadata but
+// maintaining orientation.
+type ImageProcessor struct {
+	// Decode decodes the source image. Nil means image.Decode, which
+	// handles any format registered with the image package.
+	Decode func(io.Reader) (image.Image, error)
+}
+
+// Process implements Processor.
+func (p ImageProcessor) Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	return convertToJpg(ctx, r, w, p.Decode, opts)
+}
+
+// OutputExt implements FormatChanger.
+func (ImageProcessor) OutputExt(opts Options) string {
+	return ".jpg"
+}
+
+// convertToJpg converts an image to JPG without preserving metadata but maintaining orientation
+func convertToJpg(ctx context.Context, r io.Reader, w io.Writer, decode func(io.Reader) (image.Image, error), opts Options) error {
+	input, err := asReadSeeker(r)
+	if err != nil {
+		return fmt.Errorf("error reading input: %w", err)
+	}
+
+	// Refuse decompression bombs before the pixels are decoded
+	if err := opts.Limits.checkImage(input); err != nil {
+		return err
+	}
+
+	// Collect the metadata the policy keeps before it is discarded
+	var retained []byte
+	if opts.Policy.KeepsAny() {
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return fmt.Errorf("error reading input: %w", err)
+		}
+		retained, err = retainedJPEGSegments(data, opts.Policy)
+		if err != nil {
+			return err
+		}
+		input = bytes.NewReader(data)
+	}
+
 	// Extract orientation
 	orientation := 1
-	metadata, err := imagemeta.Decode(fileInput)
+	metadata, err := imagemeta.Decode(input)
 	if err == nil && metadata.Orientation > 0 && metadata.Orientation <= 8 {
 		orientation = int(metadata.Orientation)
 	}
 
 	// Reset file pointer to the beginning
-	_, err = fileInput.Seek(0, 0)
+	_, err = input.Seek(0, io.SeekStart)
 	if err != nil {
-		return fmt.Errorf("error resetting file pointer: %v", err)
+		return fmt.Errorf("error resetting file pointer: %w", err)
 	}
 
-	var img image.Image
-
-	// Determine file type and decode accordingly
-	ext := strings.ToLower(filepath.Ext(input))
-	switch ext {
-	case ".heic":
-		img, err = goheif.Decode(fileInput)
-	case ".png":
-		img, err = png.Decode(fileInput)
-	default:
-		img, _, err = image.Decode(fileInput)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
+	var img image.Image
+	if decode != nil {
+		img, err = decode(input)
+	} else {
+		img, _, err = image.Decode(input)
+	}
 	if err != nil {
-		return fmt.Errorf("error decoding image: %v", err)
+		return decodeError(fmt.Errorf("error decoding image: %w", err))
 	}
 
 	// Apply orientation
 	img = ApplyOrientation(img, orientation)
 
-	fileOutput, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	img, err = finishImage(ctx, img, opts)
 	if err != nil {
-		return fmt.Errorf("error creating output file: %v", err)
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	defer fileOutput.Close()
 
 	// Encode as JPEG without any metadata
-	opts := jpeg.Options{Quality: 90}
-	err = jpeg.Encode(fileOutput, img, &opts)
-	if err != nil {
-		return fmt.Errorf("error encoding JPEG: %v", err)
+	if len(retained) == 0 {
+		err = jpeg.Encode(w, img, &jpeg.Options{Quality: opts.jpegQuality()})
+		if err != nil {
+			return fmt.Errorf("error encoding JPEG: %w", err)
+		}
+		return nil
 	}
 
+	// Re-insert the retained segments straight after SOI
+	var encoded bytes.Buffer
+	err = jpeg.Encode(&encoded, img, &jpeg.Options{Quality: opts.jpegQuality()})
+	if err != nil {
+		return fmt.Errorf("error encoding JPEG: %w", err)
+	}
+	out := encoded.Bytes()
+	for _, chunk := range [][]byte{out[:2], retained, out[2:]} {
+		if _, err := w.Write(chunk); err != nil {
+			return fmt.Errorf("error writing output: %w", err)
+		}
+	}
 	return nil
 }
 
-// convertMovToMp4 converts a MOV or MP4 file to MP4 using FFmpeg
-func convertMovToMp4(input, output string) error {
-	cmd := exec.Command("ffmpeg",
-		"-i", input,
-		"-map_metadata", "-1", // Remove all metadata
-		"-c:v", "libx264",
-		"-crf", "23",
-		"-preset", "medium",
-		"-c:a", "aac",
-		"-b:a", "128k",
-		"-movflags", "+faststart",
-		"-y", output)
+// finishImage applies the redaction, in displayed coordinates, and then the
+// fingerprint mitigation to an upright image before it is encoded.
+func finishImage(ctx context.Context, img image.Image, opts Options) (image.Image, error) {
+	if opts.Redaction != nil {
+		var err error
+		img, err = opts.Redaction.Apply(ctx, img)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strength := opts.antiFingerprint(); strength > 0 {
+		img = reduceSensorFingerprint(img, strength)
+	}
+	return img, nil
+}
 
-	var stderr strings.Builder
-	cmd.Stderr = &stderr
+// asReadSeeker returns r itself when it can seek, otherwise it buffers the
+// whole stream in memory.
+func asReadSeeker(r io.Reader) (io.ReadSeeker, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs, nil
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// VideoProcessor scrubs MOV and MP4 streams. By default metadata boxes are
+// removed in place, keeping the container and the media data as they are;
+// with Options.Profile or Options.Redaction the video is transcoded using
+// its Transcoder.
+type VideoProcessor struct {
+	// Transcoder probes and transcodes the videos. Nil uses
+	// DefaultTranscoder.
+	Transcoder Transcoder
+}
 
-	err := cmd.Run()
+func (p VideoProcessor) transcoder() Transcoder {
+	if p.Transcoder != nil {
+		return p.Transcoder
+	}
+	return DefaultTranscoder
+}
+
+// Process implements Processor. FFmpeg needs a seekable input to find the
+// moov atom, so non-file readers are spooled to a temporary file first.
+func (p VideoProcessor) Process(ctx context.Context, r io.Reader, w io.Writer, opts Options) error {
+	profile := opts.videoProfile()
+	if profile == nil {
+		return rewriteVideo(ctx, r, w, opts)
+	}
+
+	scratch := opts.scratch()
+	inputPath, cleanup, err := spoolToFile(r, scratch)
 	if err != nil {
-		return fmt.Errorf("FFmpeg command failed: %v\nFFmpeg error output:\n%s", err, stderr.String())
+		return err
 	}
+	defer cleanup()
 
+	if f, ok := w.(*os.File); ok && isRegularFile(f) {
+		return transcodeVideo(ctx, p.transcoder(), inputPath, f.Name(), opts)
+	}
+
+	tempOutput, err := scratch.CreateTemp("scrub-out-*" + profile.OutputExt())
+	if err != nil {
+		return fmt.Errorf("error creating temporary output file: %w", err)
+	}
+	defer scratch.Remove(tempOutput)
+
+	err = transcodeVideo(ctx, p.transcoder(), inputPath, tempOutput.Name(), opts)
+	if err != nil {
+		return err
+	}
+
+	_, err = copyOut(w, tempOutput)
+	if err != nil {
+		return fmt.Errorf("error writing output: %w", err)
+	}
 	return nil
 }
 
-// IsSupported checks if a given file is supported based on its extension
-func IsSupported(filePath string) bool {
-	ext := strings.ToLower(filepath.Ext(filePath))
-	_, supported := SupportedExtensions[ext]
-	return supported
+// OutputExt implements FormatChanger.
+func (VideoProcessor) OutputExt(opts Options) string {
+	if profile := opts.videoProfile(); profile != nil {
+		return profile.OutputExt()
+	}
+	return ""
 }
 
-// GenerateOrderedFilename generates a filename with an ordered prefix
-func GenerateOrderedFilename(order int, ext string) string {
-	// Generate the ordered prefix
-	orderPrefix := fmt.Sprintf("%06d", order)
+// spoolToFile returns a path FFmpeg can read r from. Regular files are used
+// in place; anything else is copied to a file of the scratch job that
+// cleanup wipes. The file stays open until then, as memory files only exist
+// while they are open.
+func spoolToFile(r io.Reader, scratch *ScratchJob) (path string, cleanup func(), err error) {
+	if f, ok := r.(*os.File); ok && isRegularFile(f) {
+		return f.Name(), func() {}, nil
+	}
 
-	// Generate the random part
-	randomBytes := make([]byte, 4)
-	if _, err := rand.Read(randomBytes); err != nil {
-		panic(err) // handle error appropriately in production code
+	tempInput, err := scratch.CreateTemp("scrub-in-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("error creating temporary input file: %w", err)
 	}
-	randomPart := hex.EncodeToString(randomBytes)
+	cleanup = func() { scratch.Remove(tempInput) }
 
-	// Determine the output extension
-	outputExt := ".jpg"
-	if strings.ToLower(ext) == ".mov" || strings.ToLower(ext) == ".mp4" {
-		outputExt = ".mp4"
-	}
-
-	return fmt.Sprintf("%s_%s%s", orderPrefix, randomPart, outputExt)
-}
-
-func ApplyOrientation(img image.Image, orientation int) image.Image {
-	switch orientation {
-	case 1:
-		return img // No rotation needed
-	case 2:
-		return flipHorizontal(img)
-	case 3:
-		return rotate180(img)
-	case 4:
-		return flipVertical(img)
-	case 5:
-		return transpose(img)
-	case 6:
-		return rotate90(img) // Changed from rotate270 to rotate90
-	case 7:
-		return transverse(img)
-	case 8:
-		return rotate270(img)
-	default:
-		fmt.Printf("Warning: Unknown orientation %d, returning original image\n", orientation)
-		return img
+	_, err = io.Copy(tempInput, r)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("error writing temporary input file: %w", err)
 	}
+	return tempInput.Name(), cleanup, nil
+}
+
+func isRegularFile(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
 }
 
-func flipHorizontal(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(bounds)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			newImg.Set(bounds.Max.X-x-1, y, img.At(x, y))
+// transcodeVideo converts a MOV or MP4 file to MP4 with t using the
+// encoders of the profile, redacting the video if opts.Redaction is set.
+func transcodeVideo(ctx context.Context, t Transcoder, input, output string, opts Options) error {
+	profile := opts.videoProfile()
+
+	// A transcoder that cannot report its capabilities fails below when it
+	// is run; one that can is checked for the profile's encoders up front
+	if caps, err := t.Capabilities(ctx); err == nil {
+		if err := caps.CheckProfile(*profile); err != nil {
+			return err
 		}
 	}
-	return newImg
-}
 
-func flipVertical(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(bounds)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			newImg.Set(x, bounds.Max.Y-y-1, img.At(x, y))
+	// The probe picks the streams to keep and gives the duration for
+	// progress. Without ffprobe the first video and audio streams are kept
+	// and only completion can be reported.
+	probed, probeErr := probe(ctx, t, input)
+	if probeErr != nil {
+		probed = nil
+	}
+
+	// Container tags the policy keeps are written back explicitly
+	var retained []string
+	if opts.Policy.KeepsAny() {
+		if probeErr != nil {
+			return probeErr
 		}
+		retained = retainedVideoTags(probed, opts.Policy)
+	}
+
+	movflags := "+faststart"
+	if len(retained) > 0 {
+		// Needed for the MP4 muxer to write tags outside its built-in set
+		movflags += "+use_metadata_tags"
+	}
+
+	var duration float64
+	if probed != nil {
+		duration = probed.duration()
 	}
-	return newImg
-}
 
-func transpose(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dy(), bounds.Dx()))
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			newImg.Set(y, x, img.At(x, y))
+	// Oversized videos are refused before FFmpeg decodes anything
+	if opts.Limits.limitsVideo() {
+		if probeErr != nil {
+			return probeErr
+		}
+		if err := opts.Limits.checkDuration(duration); err != nil {
+			return err
+		}
+		if video, found := keptVideoStream(probed, profile); found {
+			if err := opts.Limits.checkDimensions(video.displaySize()); err != nil {
+				return err
+			}
 		}
 	}
-	return newImg
-}
 
-func transverse(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dy(), bounds.Dx()))
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			newImg.Set(bounds.Max.Y-y-1, bounds.Max.X-x-1, img.At(x, y))
+	// Timecode, subtitle and data streams such as GPS telemetry are never
+	// mapped, and neither are chapters or any stream's metadata
+	streamMap, dropped := selectStreams(probed, profile)
+
+	// The redaction is checked against the probed video, so bad regions or
+	// times fail here rather than halfway through encoding
+	var filterArgs []string
+	if opts.Redaction != nil && profile.VideoCodec != "" {
+		if profile.VideoCodec == "copy" {
+			return fmt.Errorf("%w: profile %q copies the video stream and cannot redact it", ErrInvalidRedaction, profile.Name)
+		}
+		if probeErr != nil {
+			return probeErr
+		}
+		if video, found := keptVideoStream(probed, profile); found {
+			width, height := video.displaySize()
+			graph, err := videoRedactionFilter(*opts.Redaction, "0:"+strconv.Itoa(video.Index),
+				width, height, duration, profile.scaleFilter(), "redacted")
+			if err != nil {
+				return err
+			}
+			filterArgs = []string{"-filter_complex", graph}
+			for i, arg := range streamMap {
+				if arg == "0:"+strconv.Itoa(video.Index) {
+					streamMap[i] = "[redacted]"
+				}
+			}
 		}
 	}
-	return newImg
-}
 
-func rotate90(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dy(), bounds.Dx()))
-	draw.NearestNeighbor.Transform(newImg, f64.Aff3{0, -1, float64(bounds.Dy()), 1, 0, 0}, img, bounds, draw.Over, nil)
-	return newImg
+	args := []string{
+		"-progress", "pipe:1",
+		"-nostats",
+		"-i", input,
+	}
+	args = append(args, filterArgs...)
+	args = append(args, streamMap...)
+	args = append(args,
+		"-map_metadata", "-1", // Remove all metadata
+		"-map_chapters", "-1",
+	)
+	args = append(args, retained...)
+	args = append(args, profile.codecArgs(filterArgs == nil)...)
+	args = append(args,
+		"-fflags", "+bitexact", // Leave out the muxer's encoder tag
+		"-movflags", movflags,
+		"-f", "mp4",
+		"-y", output)
+
+	opts.reportDropped(dropped)
+
+	var progress io.Writer
+	if opts.Progress != nil {
+		progress = newFFmpegProgress(duration, opts.reportProgress)
+	}
+	return t.Transcode(ctx, args, progress)
 }
 
-func rotate180(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(bounds)
-	draw.NearestNeighbor.Transform(newImg, f64.Aff3{-1, 0, float64(bounds.Dx()), 0, -1, float64(bounds.Dy())}, img, bounds, draw.Over, nil)
-	return newImg
+// IsSupported checks if a given file is supported based on its detected
+// format, or on its extension if the file cannot be read.
+func IsSupported(filePath string) bool {
+	ext, _, err := ResolveFileExt(filePath)
+	if err != nil {
+		ext = filepath.Ext(filePath)
+	}
+	_, supported := DefaultRegistry.Lookup(ext)
+	return supported
 }
 
-func rotate270(img image.Image) image.Image {
-	bounds := img.Bounds()
-	newImg := image.NewRGBA(image.Rect(0, 0, bounds.Dy(), bounds.Dx()))
-	draw.NearestNeighbor.Transform(newImg, f64.Aff3{0, 1, 0, -1, 0, float64(bounds.Dx())}, img, bounds, draw.Over, nil)
-	return newImg
+// GenerateOrderedFilename generates a filename with an ordered prefix. ext is
+// the input file's extension; the output extension comes from the processor
+// that handles it.
+func GenerateOrderedFilename(order int, ext string, opts Options) string {
+	// Generate the ordered prefix
+	orderPrefix := fmt.Sprintf("%06d", order)
+
+	// Generate the random part
+	randomBytes := make([]byte, 4)
+	if _, err := rand.Read(randomBytes); err != nil {
+		panic(err) // handle error appropriately in production code
+	}
+	randomPart := hex.EncodeToString(randomBytes)
+
+	return fmt.Sprintf("%s_%s%s", orderPrefix, randomPart, OutputExt(ext, opts))
 }
 
 // GetOrientation extracts the orientation from an image file
 func GetOrientation(input string) (int, error) {
 	fileInput, err := os.Open(input)
 	if err != nil {
-		return 1, fmt.Errorf("error opening input file: %v", err)
+		return 1, fmt.Errorf("error opening input file: %w", err)
 	}
 	defer fileInput.Close()
 
@@ -0,0 +1,149 @@
+package mediaprocessor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// transcodeFiles writes a placeholder input video and returns its path and
+// the path of the output.
+func transcodeFiles(t *testing.T) (input, output string) {
+	t.Helper()
+	dir := t.TempDir()
+	input, output = filepath.Join(dir, "in.mov"), filepath.Join(dir, "out.mp4")
+	if err := os.WriteFile(input, []byte("video"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return input, output
+}
+
+// mapArgs returns the values of the -map arguments in args.
+func mapArgs(args []string) []string {
+	var maps []string
+	for i, arg := range args {
+		if arg == "-map" && i+1 < len(args) {
+			maps = append(maps, args[i+1])
+		}
+	}
+	return maps
+}
+
+func TestTranscodeVideo(t *testing.T) {
+	input, output := transcodeFiles(t)
+	fake := &fakeTranscoder{ProbeJSON: []byte(fakeProbeWithExtras)}
+
+	var dropped []DroppedTrack
+	var progress []float64
+	opts := Options{
+		Profile:      &ProfileH264,
+		TrackDropped: func(track DroppedTrack) { dropped = append(dropped, track) },
+		Progress:     func(percent float64) { progress = append(progress, percent) },
+	}
+	if err := transcodeVideo(context.Background(), fake, input, output, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := fake.Calls()
+	if len(calls) != 1 {
+		t.Fatalf("%d Transcode calls, want 1", len(calls))
+	}
+	args := calls[0]
+	if want := []string{"-progress", "pipe:1", "-nostats", "-i", input}; !slices.Equal(args[:len(want)], want) {
+		t.Errorf("args start with %q, want %q", args[:len(want)], want)
+	}
+	if want := []string{"-f", "mp4", "-y", output}; !slices.Equal(args[len(args)-len(want):], want) {
+		t.Errorf("args end with %q, want %q", args[len(args)-len(want):], want)
+	}
+	if maps := mapArgs(args); !slices.Equal(maps, []string{"0:1", "0:2"}) {
+		t.Errorf("maps = %q, want the video and first audio stream", maps)
+	}
+	for _, want := range [][]string{{"-map_metadata", "-1"}, {"-map_chapters", "-1"}, {"-c:v", "libx264"}, {"-movflags", "+faststart"}} {
+		i := slices.Index(args, want[0])
+		if i < 0 || i+1 >= len(args) || args[i+1] != want[1] {
+			t.Errorf("args %q lack %q", args, want)
+		}
+	}
+
+	wantDropped := []DroppedTrack{
+		{Index: 0, Type: "video", Codec: "mjpeg"},
+		{Index: 3, Type: "audio", Codec: "mp4a"},
+		{Index: 4, Type: "data", Codec: "tmcd"},
+		{Index: 5, Type: "subtitle", Codec: "tx3g"},
+		{Index: 6, Type: "data", Codec: "bin_data"},
+	}
+	if !reflect.DeepEqual(dropped, wantDropped) {
+		t.Errorf("dropped = %+v, want %+v", dropped, wantDropped)
+	}
+	if len(progress) == 0 || progress[len(progress)-1] != 100 {
+		t.Errorf("progress = %v, want it to end at 100", progress)
+	}
+	if data, err := os.ReadFile(output); err != nil || string(data) != "video" {
+		t.Errorf("output = %q, %v", data, err)
+	}
+}
+
+func TestTranscodeVideoRedaction(t *testing.T) {
+	input, output := transcodeFiles(t)
+	fake := &fakeTranscoder{}
+	opts := Options{Redaction: &Redaction{Mode: RedactFill, Regions: []Region{{X: 10, Y: 10, Width: 100, Height: 100}}}}
+	if err := transcodeVideo(context.Background(), fake, input, output, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	args := fake.Calls()[0]
+	if !slices.Contains(args, "-filter_complex") {
+		t.Errorf("args %q have no filter graph", args)
+	}
+	if maps := mapArgs(args); !slices.Equal(maps, []string{"[redacted]", "0:1"}) {
+		t.Errorf("maps = %q, want the redacted video and the audio", maps)
+	}
+}
+
+func TestTranscodeVideoWithoutProbe(t *testing.T) {
+	input, output := transcodeFiles(t)
+	fake := &fakeTranscoder{ProbeJSON: []byte("not JSON")}
+	var dropped []DroppedTrack
+	opts := Options{Profile: &ProfileH264, TrackDropped: func(track DroppedTrack) { dropped = append(dropped, track) }}
+	if err := transcodeVideo(context.Background(), fake, input, output, opts); err != nil {
+		t.Fatal(err)
+	}
+	if maps := mapArgs(fake.Calls()[0]); !slices.Equal(maps, []string{"0:V:0?", "0:a:0?"}) {
+		t.Errorf("maps = %q, want the first video and audio streams", maps)
+	}
+	if len(dropped) != 0 {
+		t.Errorf("dropped = %+v, want nothing reported", dropped)
+	}
+
+	// Keeping metadata needs the probe to know what to write back
+	opts.Policy = Policy{Mode: PolicyAllow, Groups: []TagGroup{GroupCaptureDate}}
+	if err := transcodeVideo(context.Background(), fake, input, output, opts); err == nil {
+		t.Error("transcoding without a probe kept metadata")
+	}
+}
+
+func TestTranscodeVideoMissingEncoder(t *testing.T) {
+	input, output := transcodeFiles(t)
+	fake := &fakeTranscoder{Encoders: []string{"aac", "libx264"}}
+	err := transcodeVideo(context.Background(), fake, input, output, Options{Profile: &ProfileHEVC})
+	if !errors.Is(err, ErrTranscoderUnavailable) {
+		t.Errorf("got %v, want ErrTranscoderUnavailable", err)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("FFmpeg was run %d times", len(calls))
+	}
+}
+
+func TestTranscodeVideoCancelled(t *testing.T) {
+	input, output := transcodeFiles(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := transcodeVideo(ctx, &fakeTranscoder{}, input, output, Options{Profile: &ProfileH264})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
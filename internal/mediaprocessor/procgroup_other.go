@@ -0,0 +1,14 @@
+//go:build !unix
+
+package mediaprocessor
+
+import (
+	"os/exec"
+	"time"
+)
+
+// killProcessGroupOnCancel falls back to killing only the FFmpeg process on
+// platforms without process groups.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = 5 * time.Second
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package mediaprocessor
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// killProcessGroupOnCancel starts cmd in a new process group and makes
+// context cancellation kill the entire group, so helpers FFmpeg forks do not
+// outlive the job.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+}
@@ -0,0 +1,184 @@
+package mediaprocessor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Profile describes how FFmpeg re-encodes a video.
+type Profile struct {
+	Name string `json:"name"`
+
+	// VideoCodec is the FFmpeg video encoder, or "copy" to keep the video
+	// stream as it is. Empty drops the video.
+	VideoCodec string `json:"video_codec,omitempty"`
+	// CRF is the constant rate factor passed to the encoder. Zero leaves the
+	// encoder's default.
+	CRF int `json:"crf,omitempty"`
+	// Preset is the encoder speed preset, such as "fast" or "slow".
+	Preset string `json:"preset,omitempty"`
+	// MaxDimension caps the longer side of the video in pixels, keeping the
+	// aspect ratio. Zero keeps the source resolution.
+	MaxDimension int `json:"max_dimension,omitempty"`
+
+	// AudioCodec is the FFmpeg audio encoder, or "copy" to keep the audio
+	// stream as it is. Empty drops the audio.
+	AudioCodec string `json:"audio_codec,omitempty"`
+	// AudioBitrate is the target audio bitrate, such as "128k".
+	AudioBitrate string `json:"audio_bitrate,omitempty"`
+}
+
+// Built-in profiles.
+var (
+	ProfilePassthrough = Profile{Name: "passthrough", VideoCodec: "copy", AudioCodec: "copy"}
+	ProfileH264        = Profile{Name: "h264", VideoCodec: "libx264", CRF: 23, Preset: "medium", AudioCodec: "aac", AudioBitrate: "128k"}
+	ProfileH264Small   = Profile{Name: "h264-small", VideoCodec: "libx264", CRF: 28, Preset: "faster", MaxDimension: 1280, AudioCodec: "aac", AudioBitrate: "96k"}
+	ProfileH264High    = Profile{Name: "h264-high", VideoCodec: "libx264", CRF: 18, Preset: "slow", AudioCodec: "aac", AudioBitrate: "192k"}
+	ProfileH2641080p   = Profile{Name: "h264-1080p", VideoCodec: "libx264", CRF: 23, Preset: "medium", MaxDimension: 1920, AudioCodec: "aac", AudioBitrate: "128k"}
+	ProfileH264720p    = Profile{Name: "h264-720p", VideoCodec: "libx264", CRF: 23, Preset: "medium", MaxDimension: 1280, AudioCodec: "aac", AudioBitrate: "128k"}
+	ProfileHEVC        = Profile{Name: "hevc", VideoCodec: "libx265", CRF: 28, Preset: "medium", AudioCodec: "aac", AudioBitrate: "128k"}
+	ProfileAudioOnly   = Profile{Name: "audio-only", AudioCodec: "aac", AudioBitrate: "128k"}
+)
+
+var (
+	profilesMu sync.RWMutex
+	profiles   = map[string]Profile{}
+)
+
+func init() {
+	for _, p := range []Profile{
+		ProfilePassthrough,
+		ProfileH264,
+		ProfileH264Small,
+		ProfileH264High,
+		ProfileH2641080p,
+		ProfileH264720p,
+		ProfileHEVC,
+		ProfileAudioOnly,
+	} {
+		profiles[p.Name] = p
+	}
+}
+
+// RegisterProfile makes p selectable by name, replacing any profile with the
+// same name.
+func RegisterProfile(p Profile) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	profiles[p.Name] = p
+	return nil
+}
+
+// ProfileNames returns the names of all registered profiles in sorted order.
+func ProfileNames() []string {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParseProfile returns the registered profile with the given name. An empty
+// name returns nil, which scrubs videos in place without re-encoding.
+func ParseProfile(name string) (*Profile, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, nil
+	}
+	profilesMu.RLock()
+	p, found := profiles[name]
+	profilesMu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(ProfileNames(), ", "))
+	}
+	return &p, nil
+}
+
+// Validate checks that the profile has a name and produces at least one
+// stream.
+func (p Profile) Validate() error {
+	switch {
+	case p.Name == "":
+		return fmt.Errorf("profile has no name")
+	case p.VideoCodec == "" && p.AudioCodec == "":
+		return fmt.Errorf("profile %q drops both video and audio", p.Name)
+	case p.CRF < 0 || p.CRF > 63:
+		return fmt.Errorf("profile %q has invalid CRF %d", p.Name, p.CRF)
+	case p.MaxDimension < 0:
+		return fmt.Errorf("profile %q has invalid max dimension %d", p.Name, p.MaxDimension)
+	case p.MaxDimension > 0 && p.VideoCodec == "copy":
+		return fmt.Errorf("profile %q cannot resize a copied video stream", p.Name)
+	}
+	return nil
+}
+
+// OutputExt returns the extension of the files the profile produces.
+func (p Profile) OutputExt() string {
+	if p.VideoCodec == "" {
+		return ".m4a"
+	}
+	return ".mp4"
+}
+
+// CodecArgs returns the FFmpeg arguments selecting and configuring the
+// encoders.
+func (p Profile) CodecArgs() []string {
+	return p.codecArgs(true)
+}
+
+// scaleFilter returns the filter capping the video size, or "" if the
+// profile keeps the source resolution.
+func (p Profile) scaleFilter() string {
+	if p.MaxDimension <= 0 {
+		return ""
+	}
+	// Fit within a square so the cap applies to the longer side
+	return fmt.Sprintf(
+		"scale=w='min(iw,%[1]d)':h='min(ih,%[1]d)':force_original_aspect_ratio=decrease:force_divisible_by=2",
+		p.MaxDimension)
+}
+
+// codecArgs returns the encoder arguments, leaving out the scale filter
+// unless scale is set, for when it is part of a filter graph instead.
+func (p Profile) codecArgs(scale bool) []string {
+	var args []string
+
+	if p.VideoCodec == "" {
+		args = append(args, "-vn")
+	} else {
+		args = append(args, "-c:v", p.VideoCodec)
+		if p.CRF > 0 {
+			args = append(args, "-crf", strconv.Itoa(p.CRF))
+		}
+		if p.Preset != "" {
+			args = append(args, "-preset", p.Preset)
+		}
+		if filter := p.scaleFilter(); filter != "" && scale {
+			args = append(args, "-vf", filter)
+		}
+		if p.VideoCodec == "libx265" {
+			// Lets Apple players recognise the stream
+			args = append(args, "-tag:v", "hvc1")
+		}
+	}
+
+	if p.AudioCodec == "" {
+		args = append(args, "-an")
+	} else {
+		args = append(args, "-c:a", p.AudioCodec)
+		if p.AudioBitrate != "" {
+			args = append(args, "-b:a", p.AudioBitrate)
+		}
+	}
+
+	return args
+}
@@ -0,0 +1,83 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// reportProgress passes percent to the Progress callback, if any.
+func (o Options) reportProgress(percent float64) {
+	if o.Progress != nil {
+		o.Progress(min(max(percent, 0), 100))
+	}
+}
+
+// ffmpegProgress parses the key=value lines FFmpeg writes with -progress and
+// reports how far the output has got through a source of known duration.
+type ffmpegProgress struct {
+	duration float64 // seconds, 0 if unknown
+	report   func(percent float64)
+	partial  []byte
+}
+
+func newFFmpegProgress(duration float64, report func(percent float64)) *ffmpegProgress {
+	return &ffmpegProgress{duration: duration, report: report}
+}
+
+// Write implements io.Writer.
+func (p *ffmpegProgress) Write(data []byte) (int, error) {
+	p.partial = append(p.partial, data...)
+	for {
+		i := bytes.IndexByte(p.partial, '\n')
+		if i < 0 {
+			break
+		}
+		p.parseLine(string(p.partial[:i]))
+		p.partial = p.partial[i+1:]
+	}
+	return len(data), nil
+}
+
+func (p *ffmpegProgress) parseLine(line string) {
+	key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+	if !found {
+		return
+	}
+	switch key {
+	case "out_time_us", "out_time_ms":
+		// Both are in microseconds despite the name of the older key
+		if p.duration <= 0 {
+			return
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return // "N/A" before the first frame is written
+		}
+		p.report(float64(us) / 1e6 / p.duration * 100)
+	case "progress":
+		if value == "end" {
+			p.report(100)
+		}
+	}
+}
+
+// progressWriter reports the share of an output of known size written so
+// far.
+type progressWriter struct {
+	w       io.Writer
+	total   int64
+	written int64
+	report  func(percent float64)
+}
+
+// Write implements io.Writer.
+func (p *progressWriter) Write(data []byte) (int, error) {
+	n, err := p.w.Write(data)
+	p.written += int64(n)
+	if p.total > 0 {
+		p.report(float64(p.written) / float64(p.total) * 100)
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+package mediaprocessor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFFmpegProgress(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration float64
+		writes   []string
+		want     []float64
+	}{
+		{
+			name:     "known duration",
+			duration: 10,
+			writes:   []string{"frame=1\nout_time_us=N/A\nout_time_us=2500000\nout_ti", "me_ms=5000000\nprogress=continue\n", "progress=end\n"},
+			want:     []float64{25, 50, 100},
+		},
+		{
+			name:     "unknown duration",
+			duration: 0,
+			writes:   []string{"out_time_us=2500000\nprogress=continue\nprogress=end\n"},
+			want:     []float64{100},
+		},
+		{
+			name:     "unterminated line",
+			duration: 10,
+			writes:   []string{"out_time_us=2500000"},
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []float64
+			p := newFFmpegProgress(tt.duration, func(percent float64) { got = append(got, percent) })
+			for _, w := range tt.writes {
+				if n, err := p.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write = %d, %v", n, err)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reported %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,531 @@
+package mediaprocessor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// RedactMode selects how the pixels inside a redacted region are hidden.
+type RedactMode string
+
+const (
+	// RedactBlur applies a gaussian blur.
+	RedactBlur RedactMode = "blur"
+	// RedactPixelate replaces each block of pixels with its average colour.
+	RedactPixelate RedactMode = "pixelate"
+	// RedactFill paints the region solid black.
+	RedactFill RedactMode = "fill"
+)
+
+// Region is an area of an image or video to redact, given either as a
+// rectangle or as a polygon of at least three points. Coordinates are in
+// pixels from the top left corner of the picture as displayed, after any
+// EXIF orientation or video rotation has been applied.
+type Region struct {
+	X      int `json:"x,omitempty"`
+	Y      int `json:"y,omitempty"`
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	// Points lists the polygon's vertices as [x, y] pairs. It takes the
+	// place of the rectangle. Videos only support rectangles.
+	Points [][2]int `json:"points,omitempty"`
+
+	// Start and End limit the redaction of a video to a time range. A zero
+	// End means until the end of the video. Images ignore them.
+	Start Timecode `json:"start,omitempty"`
+	End   Timecode `json:"end,omitempty"`
+}
+
+// Timecode is a position in a video in seconds. In JSON it is either a
+// number of seconds or a string such as "00:12", "1:02:03" or "12.5".
+type Timecode float64
+
+// ParseTimecode parses seconds written as [[hh:]mm:]ss[.fff].
+func ParseTimecode(s string) (Timecode, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timecode %q", s)
+	}
+	var seconds float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil || v < 0 || math.IsInf(v, 0) || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid timecode %q", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return Timecode(seconds), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (t *Timecode) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		parsed, err := ParseTimecode(s)
+		if err != nil {
+			return err
+		}
+		*t = parsed
+		return nil
+	}
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return fmt.Errorf("invalid timecode %s", data)
+	}
+	*t = Timecode(seconds)
+	return nil
+}
+
+// Redaction hides parts of an image or video, such as faces, house numbers
+// or license plates, before it is encoded, so the original pixels never
+// reach the output. In JSON:
+//
+//	{"mode": "blur", "regions": [{"x": 10, "y": 20, "width": 200, "height": 80}, {"points": [[400, 50], [520, 60], [460, 180]]}]}
+//	{"mode": "fill", "regions": [{"x": 640, "y": 480, "width": 160, "height": 48, "start": "00:12", "end": "00:18"}]}
+type Redaction struct {
+	Mode    RedactMode `json:"mode"`
+	Regions []Region   `json:"regions"`
+
+	// Strength is the blur radius (the gaussian's standard deviation for
+	// images, the box radius for videos) or the pixelation block size, in
+	// pixels, at most 1000. Zero scales it to each region.
+	Strength int `json:"strength,omitempty"`
+}
+
+// ParseRedaction parses a redaction written as JSON. An empty string means
+// no redaction.
+func ParseRedaction(s string) (*Redaction, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	var r Redaction
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return nil, fmt.Errorf("invalid redaction JSON: %w", err)
+	}
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Validate checks the mode and the shape of every region.
+func (r Redaction) Validate() error {
+	switch r.Mode {
+	case RedactBlur, RedactPixelate, RedactFill:
+	default:
+		return fmt.Errorf("unknown redaction mode %q", r.Mode)
+	}
+	if len(r.Regions) == 0 {
+		return fmt.Errorf("redaction has no regions")
+	}
+	if r.Strength < 0 || r.Strength > maxRedactionStrength {
+		return fmt.Errorf("invalid redaction strength %d: must be between 0 and %d", r.Strength, maxRedactionStrength)
+	}
+	for i, region := range r.Regions {
+		switch {
+		case len(region.Points) > 0:
+			if len(region.Points) < 3 {
+				return fmt.Errorf("redaction region %d: a polygon needs at least 3 points", i)
+			}
+		case region.Width <= 0 || region.Height <= 0:
+			return fmt.Errorf("redaction region %d: width and height must be positive", i)
+		}
+		switch {
+		case region.Start < 0 || region.End < 0:
+			return fmt.Errorf("redaction region %d: times must not be negative", i)
+		case region.End != 0 && region.End <= region.Start:
+			return fmt.Errorf("redaction region %d: end %gs is not after start %gs", i, region.End, region.Start)
+		}
+	}
+	return nil
+}
+
+// bounds returns the smallest rectangle containing the region.
+func (region Region) bounds() image.Rectangle {
+	if len(region.Points) == 0 {
+		return image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height)
+	}
+	b := image.Rect(region.Points[0][0], region.Points[0][1], region.Points[0][0], region.Points[0][1])
+	for _, p := range region.Points[1:] {
+		b.Min.X, b.Min.Y = min(b.Min.X, p[0]), min(b.Min.Y, p[1])
+		b.Max.X, b.Max.Y = max(b.Max.X, p[0]), max(b.Max.Y, p[1])
+	}
+	return b
+}
+
+// contains reports whether the centre of pixel (x, y) lies inside the
+// region, using the even-odd rule for polygons.
+func (region Region) contains(x, y int) bool {
+	if len(region.Points) == 0 {
+		return image.Pt(x, y).In(region.bounds())
+	}
+	px, py := float64(x)+0.5, float64(y)+0.5
+	inside := false
+	for i, j := 0, len(region.Points)-1; i < len(region.Points); j, i = i, i+1 {
+		xi, yi := float64(region.Points[i][0]), float64(region.Points[i][1])
+		xj, yj := float64(region.Points[j][0]), float64(region.Points[j][1])
+		if (yi > py) != (yj > py) && px < (xj-xi)*(py-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// maxRedactionStrength bounds Redaction.Strength, so that requests cannot
+// ask for blurs or blocks far larger than any picture.
+const maxRedactionStrength = 1000
+
+// Apply returns img with every region redacted. Images other than RGBA and
+// NRGBA are converted to RGBA first; those two are modified in place.
+// Regions are clipped to the image, but one that lies entirely outside it
+// is an error, as it most likely means the coordinates are wrong. Apply
+// stops with ctx's error once ctx is done.
+func (r Redaction) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+
+	var dst image.Image
+	var p pixels
+	switch img := img.(type) {
+	case *image.RGBA:
+		dst, p = img, pixels{pix: img.Pix, stride: img.Stride, rect: img.Rect}
+	case *image.NRGBA:
+		dst, p = img, pixels{pix: img.Pix, stride: img.Stride, rect: img.Rect}
+	default:
+		rgba := image.NewRGBA(img.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+		dst, p = rgba, pixels{pix: rgba.Pix, stride: rgba.Stride, rect: rgba.Rect}
+	}
+
+	bounds := p.rect
+	for i, region := range r.Regions {
+		// Region coordinates are relative to the image's top left corner
+		area := region.bounds().Add(bounds.Min).Intersect(bounds)
+		if area.Empty() {
+			return nil, fmt.Errorf("%w: region %d lies outside the %dx%d image", ErrInvalidRedaction, i, bounds.Dx(), bounds.Dy())
+		}
+		inside := func(x, y int) bool {
+			return region.contains(x-bounds.Min.X, y-bounds.Min.Y)
+		}
+
+		var err error
+		switch r.Mode {
+		case RedactBlur:
+			sigma := r.Strength
+			if sigma == 0 {
+				sigma = max(area.Dx(), area.Dy())/8 + 2
+			}
+			err = blurRegion(ctx, p, area, inside, float64(sigma))
+		case RedactPixelate:
+			block := r.Strength
+			if block == 0 {
+				block = max(area.Dx(), area.Dy())/8 + 2
+			}
+			err = pixelateRegion(ctx, p, area, inside, block)
+		case RedactFill:
+			for y := area.Min.Y; y < area.Max.Y; y++ {
+				for x := area.Min.X; x < area.Max.X; x++ {
+					if inside(x, y) {
+						copy(p.pix[p.offset(x, y):], []uint8{0, 0, 0, 0xff})
+					}
+				}
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return dst, nil
+}
+
+// pixels is the pixel buffer of an RGBA or NRGBA image, four bytes per
+// pixel.
+type pixels struct {
+	pix    []uint8
+	stride int
+	rect   image.Rectangle
+}
+
+// offset returns the index in pix of the first byte of pixel (x, y).
+func (p pixels) offset(x, y int) int {
+	return (y-p.rect.Min.Y)*p.stride + (x-p.rect.Min.X)*4
+}
+
+// blurRegion replaces the pixels of area for which inside is true with a
+// gaussian blur of the image around them. The gaussian is approximated by
+// three box blurs, each a horizontal and a vertical pass of running sums, so
+// the cost depends on the size of the area and not on sigma.
+func blurRegion(ctx context.Context, p pixels, area image.Rectangle, inside func(x, y int) bool, sigma float64) error {
+	radii := gaussianBoxRadii(sigma)
+	reach := radii[0] + radii[1] + radii[2]
+
+	// Read the area plus a margin for the boxes, clamped to the image
+	src := area.Inset(-reach).Intersect(p.rect)
+	w, h := src.Dx(), src.Dy()
+	buf := make([]uint8, w*h*4)
+	for y := 0; y < h; y++ {
+		copy(buf[y*w*4:(y+1)*w*4], p.pix[p.offset(src.Min.X, src.Min.Y+y):])
+	}
+
+	// Edge pixels are repeated past the border of the read rectangle
+	tmp := make([]uint8, len(buf))
+	for _, radius := range radii {
+		for y := 0; y < h; y++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			boxBlurRow(tmp[y*w*4:(y+1)*w*4], buf[y*w*4:(y+1)*w*4], radius)
+		}
+		if err := boxBlurColumns(ctx, buf, tmp, w, h, radius); err != nil {
+			return err
+		}
+	}
+
+	for y := area.Min.Y; y < area.Max.Y; y++ {
+		for x := area.Min.X; x < area.Max.X; x++ {
+			if inside(x, y) {
+				i := ((y-src.Min.Y)*w + x - src.Min.X) * 4
+				copy(p.pix[p.offset(x, y):p.offset(x, y)+4], buf[i:i+4])
+			}
+		}
+	}
+	return nil
+}
+
+// gaussianBoxRadii returns the radii of three box blurs that, applied in
+// turn, approximate a gaussian blur with standard deviation sigma.
+func gaussianBoxRadii(sigma float64) [3]int {
+	// The widths are the odd numbers around the ideal one, the smaller
+	// used m times, so that the variances add up to sigma squared
+	ideal := math.Sqrt(4*sigma*sigma + 1)
+	lower := int(math.Floor(ideal))
+	if lower%2 == 0 {
+		lower--
+	}
+	l := float64(lower)
+	m := int(math.Round((12*sigma*sigma - 3*l*l - 12*l - 9) / (-4*l - 4)))
+
+	var radii [3]int
+	for i := range radii {
+		if i < m {
+			radii[i] = (lower - 1) / 2
+		} else {
+			radii[i] = (lower + 1) / 2
+		}
+	}
+	return radii
+}
+
+// boxBlurRow writes to dst the box blur of the row of pixels src, radius
+// pixels either side. Pixels past either end repeat the end one.
+func boxBlurRow(dst, src []uint8, radius int) {
+	n := len(src) / 4
+	width := 2*radius + 1
+	for c := 0; c < 4; c++ {
+		sum := 0
+		for k := -radius; k <= radius; k++ {
+			sum += int(src[min(max(k, 0), n-1)*4+c])
+		}
+		for i := 0; i < n; i++ {
+			dst[i*4+c] = uint8((sum + width/2) / width)
+			sum += int(src[min(i+radius+1, n-1)*4+c]) - int(src[max(i-radius, 0)*4+c])
+		}
+	}
+}
+
+// boxBlurColumns writes to dst the box blur of the columns of the w by h
+// pixels of src, radius pixels up and down. It keeps a running sum per
+// column and works a row at a time, so memory is read in order. Rows past
+// either end repeat the end one.
+func boxBlurColumns(ctx context.Context, dst, src []uint8, w, h, radius int) error {
+	stride := w * 4
+	row := func(y int) []uint8 {
+		y = min(max(y, 0), h-1)
+		return src[y*stride : (y+1)*stride]
+	}
+
+	width := 2*radius + 1
+	sums := make([]int, stride)
+	for k := -radius; k <= radius; k++ {
+		for i, v := range row(k) {
+			sums[i] += int(v)
+		}
+	}
+	for y := 0; y < h; y++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		out := dst[y*stride : (y+1)*stride]
+		for i, sum := range sums {
+			out[i] = uint8((sum + width/2) / width)
+		}
+		added, removed := row(y+radius+1), row(y-radius)
+		for i := range sums {
+			sums[i] += int(added[i]) - int(removed[i])
+		}
+	}
+	return nil
+}
+
+// pixelateRegion replaces the pixels of area for which inside is true with
+// the average colour of those pixels in their block. Blocks are aligned to
+// the area's top left corner.
+func pixelateRegion(ctx context.Context, p pixels, area image.Rectangle, inside func(x, y int) bool, block int) error {
+	for by := area.Min.Y; by < area.Max.Y; by += block {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for bx := area.Min.X; bx < area.Max.X; bx += block {
+			cell := image.Rect(bx, by, bx+block, by+block).Intersect(area)
+
+			var sum [4]int
+			var n int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					if inside(x, y) {
+						px := p.pix[p.offset(x, y):]
+						sum[0], sum[1], sum[2], sum[3] = sum[0]+int(px[0]), sum[1]+int(px[1]), sum[2]+int(px[2]), sum[3]+int(px[3])
+						n++
+					}
+				}
+			}
+			if n == 0 {
+				continue
+			}
+
+			average := []uint8{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					if inside(x, y) {
+						copy(p.pix[p.offset(x, y):], average)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// minVideoBlurSize is the smallest width and height of a blurred video area.
+const minVideoBlurSize = 4
+
+// growArea widens and heightens area to at least size, keeping it on even
+// coordinates inside frame where it fits.
+func growArea(area image.Rectangle, size int, frame image.Rectangle) image.Rectangle {
+	if area.Dx() < size {
+		area.Max.X = min(area.Min.X+size, frame.Max.X)
+		area.Min.X = max((area.Max.X-size)&^1, frame.Min.X)
+	}
+	if area.Dy() < size {
+		area.Max.Y = min(area.Min.Y+size, frame.Max.Y)
+		area.Min.Y = max((area.Max.Y-size)&^1, frame.Min.Y)
+	}
+	return area
+}
+
+// videoRedactionFilter builds an FFmpeg filter graph that redacts the video
+// stream read from input and writes the result to the output label, also
+// applying scale, if any. width and height are the displayed size of the
+// video and duration its length in seconds, or 0 if unknown. Regions are
+// clipped to the frame, but any that lies outside it or starts after the
+// video ends is an error, so bad requests fail before FFmpeg starts.
+//
+// Blurred and pixelated regions are cropped out of a copy of the frame,
+// filtered and overlaid back in place; filled regions are drawn with
+// drawbox. Each region is only enabled between its start and end.
+func videoRedactionFilter(r Redaction, input string, width, height int, duration float64, scale, output string) (string, error) {
+	if err := r.Validate(); err != nil {
+		return "", err
+	}
+	if width <= 0 || height <= 0 {
+		return "", fmt.Errorf("%w: the size of the video is unknown", ErrInvalidRedaction)
+	}
+
+	var graph []string
+	current := input
+	frame := image.Rect(0, 0, width, height)
+	for i, region := range r.Regions {
+		if len(region.Points) > 0 {
+			return "", fmt.Errorf("%w: region %d: videos only support rectangles", ErrInvalidRedaction, i)
+		}
+		if duration > 0 && float64(region.Start) >= duration {
+			return "", fmt.Errorf("%w: region %d starts at %gs, after the %gs video ends", ErrInvalidRedaction, i, region.Start, duration)
+		}
+
+		// Chroma is subsampled, so whole 2x2 blocks are covered to leave
+		// no sliver of the original behind
+		area := region.bounds().Intersect(frame)
+		if area.Empty() {
+			return "", fmt.Errorf("%w: region %d lies outside the %dx%d video", ErrInvalidRedaction, i, width, height)
+		}
+		area.Min.X, area.Min.Y = area.Min.X&^1, area.Min.Y&^1
+		area.Max.X, area.Max.Y = min(area.Max.X+area.Max.X&1, width), min(area.Max.Y+area.Max.Y&1, height)
+		if r.Mode == RedactBlur {
+			// A blur radius of 1 is the least boxblur takes, which the
+			// half-size chroma planes only allow from 4x4 up
+			area = growArea(area, minVideoBlurSize, frame)
+			if area.Dx() < minVideoBlurSize || area.Dy() < minVideoBlurSize {
+				return "", fmt.Errorf("%w: region %d cannot be blurred in a %dx%d video", ErrInvalidRedaction, i, width, height)
+			}
+		}
+
+		var enable string
+		switch {
+		case region.End > 0:
+			enable = fmt.Sprintf(":enable='between(t,%g,%g)'", region.Start, region.End)
+		case region.Start > 0:
+			enable = fmt.Sprintf(":enable='gte(t,%g)'", region.Start)
+		}
+
+		next := fmt.Sprintf("r%d", i)
+		x, y, w, h := area.Min.X, area.Min.Y, area.Dx(), area.Dy()
+		switch r.Mode {
+		case RedactFill:
+			graph = append(graph, fmt.Sprintf("[%s]drawbox=x=%d:y=%d:w=%d:h=%d:color=black:t=fill%s[%s]", current, x, y, w, h, enable, next))
+		case RedactBlur, RedactPixelate:
+			var filter string
+			if r.Mode == RedactBlur {
+				// boxblur rejects radii larger than half the chroma planes
+				radius := r.Strength
+				if radius == 0 {
+					radius = max(w, h)/8 + 2
+				}
+				radius = max(min(radius, min(w, h)/4), 1)
+				filter = fmt.Sprintf("boxblur=luma_radius=%d:luma_power=3", radius)
+			} else {
+				block := r.Strength
+				if block == 0 {
+					block = max(w, h)/8 + 2
+				}
+				filter = fmt.Sprintf("scale=%d:%d:flags=area,scale=%d:%d:flags=neighbor",
+					max((w+block-1)/block, 1), max((h+block-1)/block, 1), w, h)
+			}
+			graph = append(graph,
+				fmt.Sprintf("[%s]split[b%d][f%d]", current, i, i),
+				fmt.Sprintf("[f%d]crop=%d:%d:%d:%d,%s[m%d]", i, w, h, x, y, filter, i),
+				fmt.Sprintf("[b%d][m%d]overlay=%d:%d%s[%s]", i, i, x, y, enable, next))
+		}
+		current = next
+	}
+
+	if scale != "" {
+		graph = append(graph, fmt.Sprintf("[%s]%s[%s]", current, scale, output))
+	} else {
+		graph = append(graph, fmt.Sprintf("[%s]null[%s]", current, output))
+	}
+	return strings.Join(graph, ";"), nil
+}
@@ -0,0 +1,153 @@
+package mediaprocessor
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestVideoRedactionFilterSmallBlur(t *testing.T) {
+	tests := []struct {
+		name   string
+		region Region
+		crop   string
+		radius string
+	}{
+		{"1x1", Region{X: 11, Y: 21, Width: 1, Height: 1}, "crop=4:4:10:20", "luma_radius=1:"},
+		{"2x2 in the corner", Region{X: 638, Y: 478, Width: 2, Height: 2}, "crop=4:4:636:476", "luma_radius=1:"},
+		{"thin", Region{X: 100, Y: 100, Width: 200, Height: 2}, "crop=200:4:100:100", "luma_radius=1:"},
+		{"large", Region{X: 0, Y: 0, Width: 160, Height: 80}, "crop=160:80:0:0", "luma_radius=20:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Redaction{Mode: RedactBlur, Regions: []Region{tt.region}}
+			graph, err := videoRedactionFilter(r, "0:v:0", 640, 480, 0, "", "v")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(graph, tt.crop) {
+				t.Errorf("graph %q does not contain %q", graph, tt.crop)
+			}
+			if !strings.Contains(graph, tt.radius) {
+				t.Errorf("graph %q does not contain %q", graph, tt.radius)
+			}
+		})
+	}
+}
+
+func TestVideoRedactionFilterTinyVideo(t *testing.T) {
+	r := Redaction{Mode: RedactBlur, Regions: []Region{{Width: 2, Height: 2}}}
+	_, err := videoRedactionFilter(r, "0:v:0", 2, 2, 0, "", "v")
+	if !errors.Is(err, ErrInvalidRedaction) {
+		t.Errorf("got %v, want ErrInvalidRedaction", err)
+	}
+}
+
+func TestRedactionValidateStrength(t *testing.T) {
+	for _, strength := range []int{-1, maxRedactionStrength + 1, 200000} {
+		r := Redaction{Mode: RedactBlur, Strength: strength, Regions: []Region{{Width: 10, Height: 10}}}
+		if err := r.Validate(); err == nil {
+			t.Errorf("strength %d: got no error", strength)
+		}
+	}
+	r := Redaction{Mode: RedactBlur, Strength: maxRedactionStrength, Regions: []Region{{Width: 10, Height: 10}}}
+	if err := r.Validate(); err != nil {
+		t.Errorf("strength %d: %v", maxRedactionStrength, err)
+	}
+}
+
+func TestGaussianBoxRadii(t *testing.T) {
+	for _, sigma := range []float64{1, 2, 5, 13.7, 100, maxRedactionStrength} {
+		var variance float64
+		for _, radius := range gaussianBoxRadii(sigma) {
+			width := float64(2*radius + 1)
+			variance += (width*width - 1) / 12
+		}
+		if got := math.Sqrt(variance); math.Abs(got-sigma) > 0.1*sigma+0.5 {
+			t.Errorf("sigma %g: boxes give %g", sigma, got)
+		}
+	}
+}
+
+// checkerboard returns an RGBA image of alternating black and white pixels.
+func checkerboard(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if (x+y)%2 == 0 {
+				img.Set(x, y, color.White)
+			} else {
+				img.Set(x, y, color.Black)
+			}
+		}
+	}
+	return img
+}
+
+func TestRedactionApplyBlur(t *testing.T) {
+	img := checkerboard(64, 48)
+	r := Redaction{Mode: RedactBlur, Strength: 3, Regions: []Region{{X: 16, Y: 8, Width: 32, Height: 24}}}
+	out, err := r.Apply(context.Background(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 48; y++ {
+		for x := 0; x < 64; x++ {
+			c := out.(*image.RGBA).RGBAAt(x, y)
+			inside := x >= 16 && x < 48 && y >= 8 && y < 32
+			switch {
+			case inside && (c.R < 100 || c.R > 155):
+				t.Fatalf("pixel (%d, %d) = %d, want it blurred to grey", x, y, c.R)
+			case !inside && c.R != 0 && c.R != 255:
+				t.Fatalf("pixel (%d, %d) = %d outside the region was changed", x, y, c.R)
+			case c.A != 255:
+				t.Fatalf("pixel (%d, %d) alpha = %d", x, y, c.A)
+			}
+		}
+	}
+}
+
+func TestRedactionApplyPixelateAndFill(t *testing.T) {
+	img := checkerboard(16, 16)
+	r := Redaction{Mode: RedactPixelate, Strength: 4, Regions: []Region{{X: 0, Y: 0, Width: 8, Height: 8}}}
+	if _, err := r.Apply(context.Background(), img); err != nil {
+		t.Fatal(err)
+	}
+	if c := img.RGBAAt(3, 3); c.R != 127 {
+		t.Errorf("pixelated pixel = %d, want the block average 127", c.R)
+	}
+
+	r = Redaction{Mode: RedactFill, Regions: []Region{{X: 8, Y: 8, Width: 8, Height: 8}}}
+	if _, err := r.Apply(context.Background(), img); err != nil {
+		t.Fatal(err)
+	}
+	if c := img.RGBAAt(10, 10); c != (color.RGBA{0, 0, 0, 255}) {
+		t.Errorf("filled pixel = %v, want black", c)
+	}
+}
+
+func TestRedactionApplyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := Redaction{Mode: RedactBlur, Regions: []Region{{Width: 100, Height: 100}}}
+	if _, err := r.Apply(ctx, checkerboard(100, 100)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want context.Canceled", err)
+	}
+}
+
+// BenchmarkRedactionBlurLarge blurs a 1500x1000 region of a 12 megapixel
+// photo with the default strength.
+func BenchmarkRedactionBlurLarge(b *testing.B) {
+	img := checkerboard(4032, 3024)
+	r := Redaction{Mode: RedactBlur, Regions: []Region{{X: 1000, Y: 1000, Width: 1500, Height: 1000}}}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Apply(context.Background(), img); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
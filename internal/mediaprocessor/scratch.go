@@ -0,0 +1,322 @@
+package mediaprocessor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Scratch creates the temporary files processing needs: inputs spooled for
+// FFmpeg, transcoded outputs and outputs awaiting verification. They hold
+// the unscrubbed input or what is derived from it, so where they live
+// matters, and they are overwritten before they are deleted.
+type Scratch struct {
+	// Dir is the directory temporary files are created in. Empty uses
+	// os.TempDir.
+	Dir string
+
+	// InMemory keeps temporary files in anonymous memory (memfd on Linux)
+	// instead of Dir, so the originals never reach a filesystem. Where that
+	// is not available they are created in Dir, which CheckInMemory
+	// requires to be on tmpfs.
+	InMemory bool
+
+	run  string   // The directory Claim made, if it was called
+	lock *os.File // Held on run for as long as the process lives
+}
+
+// DefaultScratch is used for every temporary file. Programs may replace it
+// at startup, before processing any file.
+var DefaultScratch = &Scratch{}
+
+// scratchRoot is the directory under Dir that Claim creates the scratch
+// directories of every service in.
+const scratchRoot = "media-privacy-service"
+
+// scratchLockName is the lock file of a service or run directory.
+const scratchLockName = ".lock"
+
+var errLocked = errors.New("locked by another process")
+
+// TempDir returns the directory temporary files are created in: the one
+// Claim made, or else Dir.
+func (s *Scratch) TempDir() string {
+	if s.run != "" {
+		return s.run
+	}
+	return s.baseDir()
+}
+
+func (s *Scratch) baseDir() string {
+	if s.Dir != "" {
+		return s.Dir
+	}
+	return os.TempDir()
+}
+
+// CheckInMemory checks that the scratch directory is on tmpfs, so that
+// nothing written there outlives the process on disk. Memory files can
+// still be swapped out; use encrypted swap or none where that matters.
+func (s *Scratch) CheckInMemory() error {
+	dir := s.TempDir()
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("error reading scratch directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("scratch directory %s is not a directory", dir)
+	}
+	return checkTmpfs(dir)
+}
+
+// Claim gives the process a scratch directory of its own, a new run-*
+// directory in Dir/media-privacy-service/<service> that it locks for as
+// long as it lives, and wipes the files of the service's other run
+// directories whose lock is free, as the process that made them has
+// exited. It returns how many files it wiped. Call it at startup, before
+// processing any file. Nothing outside the service's directory is touched,
+// and without file locks, as on Windows, no other run is swept.
+func (s *Scratch) Claim(service string) (int, error) {
+	serviceDir := filepath.Join(s.baseDir(), scratchRoot, service)
+	if err := os.MkdirAll(serviceDir, 0o700); err != nil {
+		return 0, fmt.Errorf("error creating scratch directory: %w", err)
+	}
+
+	// Other instances starting now wait, so none sweeps the new run
+	// directory before it is locked
+	serviceLock, err := openLocked(filepath.Join(serviceDir, scratchLockName), true)
+	if err != nil {
+		return 0, err
+	}
+	defer serviceLock.Close()
+
+	run, err := os.MkdirTemp(serviceDir, "run-")
+	if err != nil {
+		return 0, fmt.Errorf("error creating scratch directory: %w", err)
+	}
+	lock, err := openLocked(filepath.Join(run, scratchLockName), true)
+	if err != nil {
+		os.Remove(run)
+		return 0, err
+	}
+	s.run, s.lock = run, lock
+
+	return sweepRuns(serviceDir, run)
+}
+
+// sweepRuns wipes the files of the run directories in serviceDir other than
+// own whose lock it can take, and removes them. A run that cannot be swept
+// is reported and left for the next start.
+func sweepRuns(serviceDir, own string) (int, error) {
+	entries, err := os.ReadDir(serviceDir)
+	if err != nil {
+		return 0, fmt.Errorf("error reading scratch directory: %w", err)
+	}
+	var count int
+	for _, entry := range entries {
+		run := filepath.Join(serviceDir, entry.Name())
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "run-") || run == own {
+			continue
+		}
+		n, err := sweepRun(run)
+		count += n
+		if err != nil {
+			fmt.Printf("Warning: Error sweeping scratch directory %s: %v\n", run, err)
+		}
+	}
+	return count, nil
+}
+
+// sweepRun wipes the files of a run directory, in it or in directories
+// under it, and removes it, unless a live process holds its lock.
+func sweepRun(run string) (int, error) {
+	lockPath := filepath.Join(run, scratchLockName)
+	lock, err := openLocked(lockPath, false)
+	if errors.Is(err, errLocked) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+
+	var count int
+	err = filepath.WalkDir(run, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || path == lockPath {
+			return nil
+		}
+		if err := wipePath(path); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, fmt.Errorf("error wiping scratch directory: %w", err)
+	}
+
+	if err := os.Remove(lockPath); err != nil {
+		return count, fmt.Errorf("error removing scratch lock: %w", err)
+	}
+	if err := os.RemoveAll(run); err != nil {
+		return count, fmt.Errorf("error removing scratch directory: %w", err)
+	}
+	return count, nil
+}
+
+// openLocked opens the lock file at path, creating it if needed, and locks
+// it as lockFile does.
+func openLocked(path string, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening scratch lock: %w", err)
+	}
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		if errors.Is(err, errLocked) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error locking %s: %w", path, err)
+	}
+	return f, nil
+}
+
+// NewJob returns a ScratchJob creating its files here.
+func (s *Scratch) NewJob() *ScratchJob {
+	return &ScratchJob{scratch: s, paths: make(map[string]bool)}
+}
+
+// ScratchJob tracks the temporary files of one job, such as a request or an
+// upload, so that none outlives it: Close wipes whatever is left. Defer
+// Close as soon as the job starts so that it also runs when the job fails or
+// panics. A ScratchJob is safe for concurrent use.
+type ScratchJob struct {
+	scratch *Scratch
+
+	mutex sync.Mutex
+	files []*os.File
+	paths map[string]bool // Tracked by path only
+}
+
+// CreateTemp creates a temporary file open for reading and writing, with a
+// name made from pattern as os.CreateTemp does. Its Name is a path other
+// programs, such as FFmpeg, can open for as long as the file stays open.
+// It is wiped by Remove or Close, whichever comes first.
+func (j *ScratchJob) CreateTemp(pattern string) (*os.File, error) {
+	var f *os.File
+	var err error
+	if j.scratch.InMemory {
+		f, err = createMemFile(pattern)
+	}
+	if !j.scratch.InMemory || errors.Is(err, errors.ErrUnsupported) {
+		f, err = os.CreateTemp(j.scratch.TempDir(), pattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.files = append(j.files, f)
+	return f, nil
+}
+
+// Track adds a file the job did not create, such as one net/http spooled
+// an upload to, to those Close wipes.
+func (j *ScratchJob) Track(path string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.paths[path] = true
+}
+
+// Remove wipes a file made by CreateTemp before the job ends, once it is no
+// longer needed.
+func (j *ScratchJob) Remove(f *os.File) {
+	j.mutex.Lock()
+	for i, file := range j.files {
+		if file == f {
+			j.files = append(j.files[:i], j.files[i+1:]...)
+			break
+		}
+	}
+	j.mutex.Unlock()
+
+	wipeFile(f)
+}
+
+// Close wipes every file the job still tracks. It may be called more than
+// once.
+func (j *ScratchJob) Close() {
+	j.mutex.Lock()
+	files, paths := j.files, j.paths
+	j.files, j.paths = nil, make(map[string]bool)
+	j.mutex.Unlock()
+
+	for _, f := range files {
+		wipeFile(f)
+	}
+	for path := range paths {
+		wipePath(path)
+	}
+}
+
+// copyOut copies the scratch file f to w by reading it. io.Copy could hand
+// f to sendfile, which leaves the pages of f for the socket to send later,
+// after they are wiped.
+func copyOut(w io.Writer, f *os.File) (int64, error) {
+	return io.Copy(w, struct{ io.Reader }{f})
+}
+
+// wipeFile overwrites f with zeros, then closes and deletes it. Memory files
+// are freed once closed. Overwriting does not reach copies the filesystem or
+// the drive keeps elsewhere, such as on copy-on-write filesystems or flash
+// storage; use tmpfs or an encrypted disk where that matters.
+func wipeFile(f *os.File) error {
+	err := overwrite(f)
+	f.Close()
+	if !isMemFile(f) {
+		if removeErr := os.Remove(f.Name()); err == nil && !os.IsNotExist(removeErr) {
+			err = removeErr
+		}
+	}
+	return err
+}
+
+// wipePath wipes the file at path as wipeFile does. Files already gone are
+// not an error.
+func wipePath(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error opening %s to wipe it: %w", path, err)
+	}
+	return wipeFile(f)
+}
+
+func overwrite(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("error wiping temporary file: %w", err)
+	}
+	zeros := make([]byte, 64<<10)
+	for offset := int64(0); offset < info.Size(); offset += int64(len(zeros)) {
+		n := min(int64(len(zeros)), info.Size()-offset)
+		if _, err := f.WriteAt(zeros[:n], offset); err != nil {
+			return fmt.Errorf("error wiping temporary file: %w", err)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("error wiping temporary file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package mediaprocessor
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// memFileDir holds the paths memory files are named by. Other processes
+// must use the pid, as /proc/self would name their own descriptors.
+var memFileDir = fmt.Sprintf("/proc/%d/fd/", os.Getpid())
+
+// createMemFile creates an anonymous memory file with memfd_create. It is
+// not inherited by child processes, which open it by its /proc path.
+func createMemFile(pattern string) (*os.File, error) {
+	name := strings.ReplaceAll(pattern, "*", "")
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("error creating memory file: %w", err)
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("%s%d", memFileDir, fd)), nil
+}
+
+func isMemFile(f *os.File) bool {
+	return strings.HasPrefix(f.Name(), memFileDir)
+}
+
+// checkTmpfs fails unless dir is on a filesystem held only in memory.
+func checkTmpfs(dir string) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(dir, &fs); err != nil {
+		return fmt.Errorf("error reading filesystem of %s: %w", dir, err)
+	}
+	switch fs.Type {
+	case unix.TMPFS_MAGIC, unix.RAMFS_MAGIC:
+		return nil
+	}
+	return fmt.Errorf("scratch directory %s is not on tmpfs", dir)
+}
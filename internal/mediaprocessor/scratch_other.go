@@ -0,0 +1,25 @@
+//go:build !linux
+
+package mediaprocessor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// createMemFile reports that memory files are Linux only, so temporary
+// files go to the scratch directory instead.
+func createMemFile(pattern string) (*os.File, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func isMemFile(f *os.File) bool {
+	return false
+}
+
+// checkTmpfs cannot tell tmpfs apart from other filesystems here, so it
+// always fails.
+func checkTmpfs(dir string) error {
+	return fmt.Errorf("cannot check that %s is on tmpfs on this platform", dir)
+}
@@ -0,0 +1,101 @@
+package mediaprocessor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != content {
+		t.Errorf("%s = %q, %v, want %q", path, data, err, content)
+	}
+}
+
+func TestScratchClaim(t *testing.T) {
+	base := t.TempDir()
+	serviceDir := filepath.Join(base, scratchRoot, "server")
+
+	// Files of other programs with names like ours, and of another service
+	foreign := filepath.Join(base, "upload-123.jpg")
+	otherService := filepath.Join(base, scratchRoot, "webserver", "run-1", "upload-1.jpg")
+	writeTestFile(t, foreign, "someone else's")
+	writeTestFile(t, otherService, "webserver's")
+
+	// A run still going
+	live := &Scratch{Dir: base}
+	if _, err := live.Claim("server"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := live.NewJob().CreateTemp("scrub-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("in progress")
+	f.Close()
+
+	// A run that crashed, leaving its files and an unlocked lock file
+	dead := filepath.Join(serviceDir, "run-dead")
+	writeTestFile(t, filepath.Join(dead, scratchLockName), "")
+	writeTestFile(t, filepath.Join(dead, "upload-1.jpg"), "original")
+	writeTestFile(t, filepath.Join(dead, "multipart-2"), "spooled")
+	writeTestFile(t, filepath.Join(dead, "frames", "frame-1.png"), "frame")
+
+	s := &Scratch{Dir: base}
+	n, err := s.Claim("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("wiped %d files, want the 3 of the crashed run", n)
+	}
+	if _, err := os.Stat(dead); !os.IsNotExist(err) {
+		t.Errorf("crashed run directory is still there: %v", err)
+	}
+	checkTestFile(t, f.Name(), "in progress")
+	checkTestFile(t, foreign, "someone else's")
+	checkTestFile(t, otherService, "webserver's")
+
+	if dir := filepath.Dir(s.TempDir()); dir != serviceDir {
+		t.Errorf("scratch files go to %s, want a directory in %s", s.TempDir(), serviceDir)
+	}
+	if s.TempDir() == live.TempDir() {
+		t.Error("two runs share a scratch directory")
+	}
+}
+
+func TestScratchClaimSkipsUnsweptRun(t *testing.T) {
+	base := t.TempDir()
+	serviceDir := filepath.Join(base, scratchRoot, "server")
+
+	// A run whose lock cannot be opened, as it is a directory
+	stuck := filepath.Join(serviceDir, "run-stuck")
+	writeTestFile(t, filepath.Join(stuck, scratchLockName, "x"), "")
+	writeTestFile(t, filepath.Join(stuck, "upload-1.jpg"), "original")
+	dead := filepath.Join(serviceDir, "run-z")
+	writeTestFile(t, filepath.Join(dead, "upload-1.jpg"), "original")
+
+	s := &Scratch{Dir: base}
+	n, err := s.Claim("server")
+	if err != nil {
+		t.Fatalf("a run that cannot be swept stopped the start: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("wiped %d files, want the 1 of the run after it", n)
+	}
+	if _, err := os.Stat(dead); !os.IsNotExist(err) {
+		t.Errorf("crashed run directory is still there: %v", err)
+	}
+}
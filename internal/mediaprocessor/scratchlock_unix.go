@@ -0,0 +1,25 @@
+//go:build unix && !aix
+
+package mediaprocessor
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile takes an exclusive lock on f, which lasts until f is closed or
+// the process exits, however it ends. Unless wait is set it fails with
+// errLocked instead of waiting for another holder to let go.
+func lockFile(f *os.File, wait bool) error {
+	how := unix.LOCK_EX
+	if !wait {
+		how |= unix.LOCK_NB
+	}
+	err := unix.Flock(int(f.Fd()), how)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return errLocked
+	}
+	return err
+}
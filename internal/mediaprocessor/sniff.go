@@ -0,0 +1,227 @@
+package mediaprocessor
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// sniffLen is how many leading bytes DetectFormat looks at, enough for the
+// ftyp box of any common MP4, QuickTime or HEIF file.
+const sniffLen = 512
+
+// formatNames names the formats DetectFormat recognizes, by extension.
+var formatNames = map[string]string{
+	".jpg":  "JPEG",
+	".png":  "PNG",
+	".heic": "HEIC",
+	".avif": "AVIF",
+	".mov":  "QuickTime",
+	".mp4":  "MP4",
+	".m4a":  "M4A",
+	".gif":  "GIF",
+	".webp": "WebP",
+	".tiff": "TIFF",
+}
+
+// heicBrands are the ftyp brands of HEVC-coded HEIF images.
+var heicBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"hevc": true, "hevx": true, "hevm": true, "hevs": true,
+}
+
+// quickTimeAtoms are the top-level atoms that start QuickTime files written
+// before the ftyp box was introduced.
+var quickTimeAtoms = map[string]bool{
+	"moov": true, "mdat": true, "wide": true, "free": true, "skip": true, "pnot": true,
+}
+
+// DetectFormat returns the extension of the format identified by the leading
+// bytes of a file, such as ".jpg", ".heic" or ".mov", or "" if they match
+// none it knows. Formats this package does not process, such as GIF, are
+// detected too so that they can be reported by name.
+func DetectFormat(header []byte) string {
+	switch {
+	case bytes.HasPrefix(header, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	case bytes.HasPrefix(header, pngSignature):
+		return ".png"
+	case bytes.HasPrefix(header, []byte("GIF87a")), bytes.HasPrefix(header, []byte("GIF89a")):
+		return ".gif"
+	case len(header) >= 12 && string(header[:4]) == "RIFF" && string(header[8:12]) == "WEBP":
+		return ".webp"
+	case bytes.HasPrefix(header, []byte("II*\x00")), bytes.HasPrefix(header, []byte("MM\x00*")):
+		return ".tiff"
+	}
+
+	if len(header) < 12 {
+		return ""
+	}
+	boxType := string(header[4:8])
+	if boxType != "ftyp" {
+		if quickTimeAtoms[boxType] {
+			return ".mov"
+		}
+		return ""
+	}
+
+	// The major brand is followed by a minor version and the compatible
+	// brands, up to the end of the box
+	end := min(int(binary.BigEndian.Uint32(header[:4])), len(header))
+	brands := []string{string(header[8:12])}
+	for i := 16; i+4 <= end; i += 4 {
+		brands = append(brands, string(header[i:i+4]))
+	}
+	switch major := brands[0]; {
+	case major == "qt  ":
+		return ".mov"
+	case major == "M4A " || major == "M4B " || major == "M4P ":
+		return ".m4a"
+	case major == "avif" || major == "avis":
+		return ".avif"
+	case heicBrands[major]:
+		return ".heic"
+	case major == "mif1" || major == "msf1":
+		// Generic HEIF: the coding comes from the compatible brands
+		for _, brand := range brands[1:] {
+			if heicBrands[brand] {
+				return ".heic"
+			}
+			if brand == "avif" || brand == "avis" {
+				return ".avif"
+			}
+		}
+		return ""
+	}
+	return ".mp4"
+}
+
+// formatAliases maps extensions to the one DetectFormat returns for the
+// same format. ISO base media files share their brands across .mp4, .m4a
+// and .m4v, so any of them suits any such file.
+var formatAliases = map[string]string{
+	".jpeg": ".jpg",
+	".heif": ".heic",
+	".tif":  ".tiff",
+	".m4a":  ".mp4",
+	".m4v":  ".mp4",
+}
+
+// sameFormat reports whether files with extensions a and b hold the same
+// format.
+func sameFormat(a, b string) bool {
+	canonical := func(ext string) string {
+		if alias, ok := formatAliases[ext]; ok {
+			return alias
+		}
+		return ext
+	}
+	return canonical(normalizeExt(a)) == canonical(normalizeExt(b))
+}
+
+// FormatMismatch describes a file whose content is not in the format its
+// extension names.
+type FormatMismatch struct {
+	// Ext is the extension of the file name.
+	Ext string
+	// Detected is the extension of the format found in the content.
+	Detected string
+}
+
+func (m FormatMismatch) String() string {
+	return fmt.Sprintf("the %s extension does not match the content, which is %s", m.Ext, formatNames[m.Detected])
+}
+
+// ResolveExt returns the extension to route the content of r by, given the
+// extension ext of its file name. The content wins when DetectFormat
+// recognizes it; ext is kept when the content is unknown or agrees with it.
+// A disagreement is also returned as a FormatMismatch. r is rewound to where
+// it was.
+func ResolveExt(r io.ReadSeeker, ext string) (string, *FormatMismatch, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", nil, fmt.Errorf("error resetting file pointer: %w", err)
+	}
+	header, err := readHeader(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return "", nil, fmt.Errorf("error resetting file pointer: %w", err)
+	}
+	resolved, mismatch := resolveExt(ext, header)
+	return resolved, mismatch, nil
+}
+
+// ResolveFileExt is ResolveExt for the file at path.
+func ResolveFileExt(path string) (string, *FormatMismatch, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening input file: %w", err)
+	}
+	defer f.Close()
+
+	return ResolveExt(f, filepath.Ext(path))
+}
+
+func resolveExt(ext string, header []byte) (string, *FormatMismatch) {
+	ext = normalizeExt(ext)
+	detected := DetectFormat(header)
+	switch {
+	case detected == "":
+		return ext, nil
+	case sameFormat(ext, detected):
+		// Keep the extension the caller used, such as .jpeg, unless
+		// nothing handles it
+		if _, supported := DefaultRegistry.Lookup(ext); supported {
+			return ext, nil
+		}
+		return detected, nil
+	case ext == "":
+		return detected, nil
+	}
+	return detected, &FormatMismatch{Ext: ext, Detected: detected}
+}
+
+// sniff resolves the extension to route the content of r by. The header is
+// read ahead, so the returned reader must be used in place of r; seekable
+// readers are rewound and returned as they are, keeping their type.
+func sniff(r io.Reader, ext string) (string, *FormatMismatch, io.Reader, error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		// Pipes and the like only look seekable
+		if _, err := rs.Seek(0, io.SeekCurrent); err == nil {
+			resolved, mismatch, err := ResolveExt(rs, ext)
+			return resolved, mismatch, r, err
+		}
+	}
+
+	header, err := readHeader(r)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	resolved, mismatch := resolveExt(ext, header)
+	return resolved, mismatch, io.MultiReader(bytes.NewReader(header), r), nil
+}
+
+// readHeader reads up to sniffLen bytes, fewer only if r ends first.
+func readHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("error reading input: %w", err)
+	}
+	return header[:n], nil
+}
+
+// unsupportedError reports that no processor handles ext, naming the
+// detected format when it is the content that gave ext away.
+func unsupportedError(ext string, mismatch *FormatMismatch) error {
+	if mismatch != nil {
+		return fmt.Errorf("%w: %s (%s)", ErrUnsupportedFormat, ext, mismatch)
+	}
+	return fmt.Errorf("%w: %s", ErrUnsupportedFormat, ext)
+}
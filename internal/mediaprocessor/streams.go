@@ -0,0 +1,89 @@
+package mediaprocessor
+
+import "strconv"
+
+// DroppedTrack describes a track removed from a video because it is neither
+// the kept video nor the kept audio, such as a timecode, subtitle or GPS
+// telemetry track.
+type DroppedTrack struct {
+	// Index is the position of the track in the source, starting at 0.
+	Index int `json:"index"`
+	// Type is the kind of track: video, audio, subtitle, data or
+	// attachment.
+	Type string `json:"type"`
+	// Codec is the sample format, such as "tmcd", "gpmd", "mebx" or "tx3g".
+	Codec string `json:"codec,omitempty"`
+}
+
+// reportDropped passes each track to the TrackDropped callback, if any.
+func (o Options) reportDropped(tracks []DroppedTrack) {
+	if o.TrackDropped == nil {
+		return
+	}
+	for _, track := range tracks {
+		o.TrackDropped(track)
+	}
+}
+
+// selectStreams returns the FFmpeg -map arguments keeping the first video
+// stream that is not cover art and the first audio stream, as far as the
+// profile encodes them. Every other stream of the source is left out and
+// returned as a dropped track. Without a probe result the first streams of
+// each kind are mapped blindly and nothing is reported.
+func selectStreams(probed *probeResult, profile *Profile) ([]string, []DroppedTrack) {
+	if probed == nil {
+		var args []string
+		if profile.VideoCodec != "" {
+			args = append(args, "-map", "0:V:0?")
+		}
+		if profile.AudioCodec != "" {
+			args = append(args, "-map", "0:a:0?")
+		}
+		return args, nil
+	}
+
+	var args []string
+	var dropped []DroppedTrack
+	video := -1
+	if s, found := keptVideoStream(probed, profile); found {
+		video = s.Index
+	}
+	audio := false
+	for _, s := range probed.Streams {
+		keep := false
+		switch s.CodecType {
+		case "video":
+			keep = s.Index == video
+		case "audio":
+			if profile.AudioCodec != "" && !audio {
+				keep, audio = true, true
+			}
+		}
+
+		if keep {
+			args = append(args, "-map", "0:"+strconv.Itoa(s.Index))
+			continue
+		}
+
+		codec := s.CodecTagString
+		if codec == "" || codec == "[0][0][0][0]" {
+			codec = s.CodecName
+		}
+		dropped = append(dropped, DroppedTrack{Index: s.Index, Type: s.CodecType, Codec: codec})
+	}
+	return args, dropped
+}
+
+// keptVideoStream returns the first video stream that is not cover art, if
+// the profile encodes video at all.
+func keptVideoStream(probed *probeResult, profile *Profile) (probeStream, bool) {
+	if profile.VideoCodec == "" {
+		return probeStream{}, false
+	}
+	for _, s := range probed.Streams {
+		if s.CodecType == "video" && s.Disposition["attached_pic"] == 0 {
+			return s, true
+		}
+	}
+	return probeStream{}, false
+}
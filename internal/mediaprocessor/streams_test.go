@@ -0,0 +1,81 @@
+package mediaprocessor
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// fakeProbeWithExtras describes a phone video with cover art, a second
+// audio track, a timecode, subtitles and GPS telemetry.
+const fakeProbeWithExtras = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "mjpeg", "disposition": {"attached_pic": 1}},
+		{"index": 1, "codec_type": "video", "codec_name": "h264", "codec_tag_string": "avc1", "width": 1920, "height": 1080},
+		{"index": 2, "codec_type": "audio", "codec_name": "aac", "codec_tag_string": "mp4a"},
+		{"index": 3, "codec_type": "audio", "codec_name": "aac", "codec_tag_string": "mp4a"},
+		{"index": 4, "codec_type": "data", "codec_name": "none", "codec_tag_string": "tmcd"},
+		{"index": 5, "codec_type": "subtitle", "codec_name": "mov_text", "codec_tag_string": "tx3g"},
+		{"index": 6, "codec_type": "data", "codec_name": "bin_data", "codec_tag_string": "[0][0][0][0]"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "10.000000"}
+}`
+
+func TestSelectStreams(t *testing.T) {
+	probed, err := probe(context.Background(), &fakeTranscoder{ProbeJSON: []byte(fakeProbeWithExtras)}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		probed  *probeResult
+		profile Profile
+		args    []string
+		dropped []DroppedTrack
+	}{
+		{
+			name:    "video and audio",
+			probed:  probed,
+			profile: ProfileH264,
+			args:    []string{"-map", "0:1", "-map", "0:2"},
+			dropped: []DroppedTrack{
+				{Index: 0, Type: "video", Codec: "mjpeg"},
+				{Index: 3, Type: "audio", Codec: "mp4a"},
+				{Index: 4, Type: "data", Codec: "tmcd"},
+				{Index: 5, Type: "subtitle", Codec: "tx3g"},
+				{Index: 6, Type: "data", Codec: "bin_data"},
+			},
+		},
+		{
+			name:    "audio only",
+			probed:  probed,
+			profile: ProfileAudioOnly,
+			args:    []string{"-map", "0:2"},
+			dropped: []DroppedTrack{
+				{Index: 0, Type: "video", Codec: "mjpeg"},
+				{Index: 1, Type: "video", Codec: "avc1"},
+				{Index: 3, Type: "audio", Codec: "mp4a"},
+				{Index: 4, Type: "data", Codec: "tmcd"},
+				{Index: 5, Type: "subtitle", Codec: "tx3g"},
+				{Index: 6, Type: "data", Codec: "bin_data"},
+			},
+		},
+		{
+			name:    "not probed",
+			profile: ProfileH264,
+			args:    []string{"-map", "0:V:0?", "-map", "0:a:0?"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, dropped := selectStreams(tt.probed, &tt.profile)
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("args = %q, want %q", args, tt.args)
+			}
+			if !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("dropped = %+v, want %+v", dropped, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+package mediaprocessor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Transcoder probes and re-encodes videos. It speaks the FFmpeg command
+// line: Transcode takes ffmpeg arguments and Probe returns an ffprobe report,
+// so other implementations, such as the fake the tests use, must understand
+// them.
+type Transcoder interface {
+	// Probe returns the JSON report of
+	// `ffprobe -print_format json -show_format -show_streams -show_chapters`
+	// for the file at path.
+	Probe(ctx context.Context, path string) ([]byte, error)
+	// Transcode runs ffmpeg with args, writing its -progress output to
+	// progress unless it is nil.
+	Transcode(ctx context.Context, args []string, progress io.Writer) error
+	// Capabilities reports the version of the transcoder and the encoders
+	// it has, or an error wrapping ErrTranscoderUnavailable if it cannot be
+	// used.
+	Capabilities(ctx context.Context) (*Capabilities, error)
+}
+
+// DefaultTranscoder is used by video processors that do not name their own.
+// Programs may replace it at startup, before processing any file.
+var DefaultTranscoder Transcoder = &FFmpeg{}
+
+// Capabilities describes what a Transcoder can do.
+type Capabilities struct {
+	// Version is the version of FFmpeg, such as "6.1.1".
+	Version string `json:"version"`
+	// Encoders lists the names of the available encoders, sorted.
+	Encoders []string `json:"encoders"`
+}
+
+// HasEncoder reports whether the named encoder is available.
+func (c *Capabilities) HasEncoder(name string) bool {
+	i := sort.SearchStrings(c.Encoders, name)
+	return i < len(c.Encoders) && c.Encoders[i] == name
+}
+
+// CheckProfile returns an error wrapping ErrTranscoderUnavailable if an
+// encoder p needs is missing.
+func (c *Capabilities) CheckProfile(p Profile) error {
+	for _, codec := range []string{p.VideoCodec, p.AudioCodec} {
+		if codec != "" && codec != "copy" && !c.HasEncoder(codec) {
+			return fmt.Errorf("%w: profile %q needs the %s encoder, which FFmpeg %s lacks", ErrTranscoderUnavailable, p.Name, codec, c.Version)
+		}
+	}
+	return nil
+}
+
+// Profiles returns the names of the registered profiles whose encoders are
+// all available, in sorted order.
+func (c *Capabilities) Profiles() []string {
+	var names []string
+	for _, name := range ProfileNames() {
+		if p, err := ParseProfile(name); err == nil && c.CheckProfile(*p) == nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// minFFmpegVersion is the oldest FFmpeg major version supported, the first
+// to report display matrix rotations in ffprobe's side data.
+const minFFmpegVersion = 4
+
+// FFmpeg is the Transcoder that runs the ffmpeg and ffprobe programs. Both
+// run in their own process group, which is killed as a whole when the
+// context is done. It is safe for concurrent use.
+type FFmpeg struct {
+	// Path and ProbePath locate ffmpeg and ffprobe. Empty looks the
+	// programs up on PATH.
+	Path      string
+	ProbePath string
+
+	mu           sync.Mutex
+	capabilities *Capabilities
+}
+
+func (f *FFmpeg) ffmpeg() string {
+	if f.Path != "" {
+		return f.Path
+	}
+	return "ffmpeg"
+}
+
+func (f *FFmpeg) ffprobe() string {
+	if f.ProbePath != "" {
+		return f.ProbePath
+	}
+	return "ffprobe"
+}
+
+// Probe implements Transcoder.
+func (f *FFmpeg) Probe(ctx context.Context, path string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, f.ffprobe(),
+		"-v", "error",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		path)
+	killProcessGroupOnCancel(cmd)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, fmt.Errorf("FFprobe command cancelled: %w", ctxErr)
+	}
+	if err != nil {
+		return nil, commandError("FFprobe", err, stderr.String())
+	}
+	return out, nil
+}
+
+// Transcode implements Transcoder.
+func (f *FFmpeg) Transcode(ctx context.Context, args []string, progress io.Writer) error {
+	cmd := exec.CommandContext(ctx, f.ffmpeg(), args...)
+	killProcessGroupOnCancel(cmd)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if progress != nil {
+		cmd.Stdout = progress
+	}
+
+	err := cmd.Run()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("FFmpeg command cancelled: %w", ctxErr)
+	}
+	if err != nil {
+		return commandError("FFmpeg", err, stderr.String())
+	}
+	return nil
+}
+
+// Capabilities implements Transcoder. It checks that ffprobe runs and that
+// ffmpeg is recent enough, then lists its encoders. A successful result is
+// kept for later calls.
+func (f *FFmpeg) Capabilities(ctx context.Context) (*Capabilities, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.capabilities != nil {
+		return f.capabilities, nil
+	}
+
+	if _, err := f.run(ctx, "FFprobe", f.ffprobe(), "-version"); err != nil {
+		return nil, err
+	}
+
+	out, err := f.run(ctx, "FFmpeg", f.ffmpeg(), "-hide_banner", "-version")
+	if err != nil {
+		return nil, err
+	}
+	// The first line reads "ffmpeg version 6.1.1-3ubuntu5 Copyright ..."
+	fields := strings.Fields(out)
+	if len(fields) < 3 || fields[1] != "version" {
+		return nil, fmt.Errorf("%w: unexpected FFmpeg version output %q", ErrTranscoderUnavailable, firstLine(out))
+	}
+	version := fields[2]
+	if major, ok := majorVersion(version); ok && major < minFFmpegVersion {
+		return nil, fmt.Errorf("%w: FFmpeg %s is older than version %d", ErrTranscoderUnavailable, version, minFFmpegVersion)
+	}
+
+	out, err = f.run(ctx, "FFmpeg", f.ffmpeg(), "-hide_banner", "-encoders")
+	if err != nil {
+		return nil, err
+	}
+
+	f.capabilities = &Capabilities{Version: version, Encoders: parseEncoders(out)}
+	return f.capabilities, nil
+}
+
+// run runs a quick informational command and returns its output.
+func (f *FFmpeg) run(ctx context.Context, name, program string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, program, args...)
+	killProcessGroupOnCancel(cmd)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return "", fmt.Errorf("%s command cancelled: %w", name, ctxErr)
+	}
+	if err != nil {
+		// A program that cannot even report its version is of no use
+		err = commandError(name, err, stderr.String())
+		if !errors.Is(err, ErrTranscoderUnavailable) {
+			err = fmt.Errorf("%w: %w", ErrTranscoderUnavailable, err)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+// majorVersion parses the major version from an FFmpeg version string such
+// as "6.1.1-3ubuntu5" or "n7.0". Builds from git, such as "N-113000-g...",
+// have none.
+func majorVersion(version string) (int, bool) {
+	version = strings.TrimPrefix(version, "n")
+	digits := version
+	if i := strings.IndexFunc(version, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		digits = version[:i]
+	}
+	major, err := strconv.Atoi(digits)
+	return major, err == nil
+}
+
+// parseEncoders lists the encoder names in the output of `ffmpeg -encoders`,
+// where each line after the "------" separator reads like
+// " V....D libx264              libx264 H.264 / AVC ...".
+func parseEncoders(out string) []string {
+	var encoders []string
+	listing := false
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !listing {
+			listing = strings.HasPrefix(fields[0], "---")
+			continue
+		}
+		if len(fields) >= 2 {
+			encoders = append(encoders, fields[1])
+		}
+	}
+	sort.Strings(encoders)
+	return encoders
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
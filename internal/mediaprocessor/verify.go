@@ -0,0 +1,241 @@
+package mediaprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Finding is a piece of metadata left in a file that should have been
+// removed.
+type Finding struct {
+	// Kind is the kind of metadata: exif, gps, xmp, iptc, icc-profile,
+	// thumbnail, other, container-tag, stream-tag, data-track or chapters.
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (f Finding) String() string {
+	if f.Detail == "" {
+		return f.Kind
+	}
+	return fmt.Sprintf("%s %s", f.Kind, f.Detail)
+}
+
+// VerificationError is returned when a scrubbed file still carries metadata
+// the policy does not keep.
+type VerificationError struct {
+	Findings []Finding
+}
+
+func (e *VerificationError) Error() string {
+	findings := make([]string, len(e.Findings))
+	for i, f := range e.Findings {
+		findings[i] = f.String()
+	}
+	return fmt.Sprintf("metadata remains after scrubbing: %s", strings.Join(findings, ", "))
+}
+
+// verifyOutput checks a scrubbed file, returning a *VerificationError if it
+// carries metadata the policy does not keep.
+func verifyOutput(ctx context.Context, path string, policy Policy) error {
+	findings, err := VerifyFile(ctx, path, policy)
+	if errors.Is(err, ErrTranscoderUnavailable) {
+		return fmt.Errorf("error verifying output: %w", err)
+	}
+	if err != nil {
+		// The output is ours, so failing to read it back is not the
+		// input's fault and must not be reported as such
+		return fmt.Errorf("error verifying output: %v", err)
+	}
+	if len(findings) > 0 {
+		return &VerificationError{Findings: findings}
+	}
+	return nil
+}
+
+// VerifyFile parses the file at path again and lists the metadata it carries
+// that the policy does not keep. Images are checked with the same parsers as
+// Inspect; videos are probed with FFprobe, or have their boxes checked where
+// it is unavailable, as the lossless rewrite needs no FFmpeg either.
+func VerifyFile(ctx context.Context, path string, policy Policy) ([]Finding, error) {
+	report, err := InspectFile(ctx, path)
+	if errors.Is(err, ErrTranscoderUnavailable) {
+		return verifyBMFFFile(path, policy)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case report.Image != nil:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading input file: %w", err)
+		}
+		return imageFindings(data, report.Image, policy), nil
+	case report.Video != nil:
+		return videoFindings(report.Video, policy), nil
+	}
+	return nil, nil
+}
+
+// verifyBMFFFile lists the metadata in the MP4 or QuickTime file at path
+// that the policy does not keep, as bmffFindings does.
+func verifyBMFFFile(path string, policy Policy) ([]Finding, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening input file: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("error reading input file: %w", err)
+	}
+	findings, err := bmffFindings(f, info.Size(), policy)
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	return findings, nil
+}
+
+// imageFindings lists the metadata in an image that the policy does not
+// keep. EXIF entries are checked one by one; the orientation tag written
+// with OrientationTag is always allowed.
+func imageFindings(data []byte, report *ImageReport, policy Policy) []Finding {
+	var findings []Finding
+
+	if raw := extractEXIF(data); raw != nil {
+		parsed, err := parseEXIF(raw)
+		if err != nil {
+			findings = append(findings, Finding{Kind: "exif", Detail: "unreadable block"})
+		} else {
+			for _, entry := range parsed.entries {
+				if entry.ifd == ifd0 && entry.tag == tagOrientation {
+					continue
+				}
+				if entry.ifd == ifdGPS {
+					findings = append(findings, Finding{Kind: "gps", Detail: fmt.Sprintf("tag 0x%04X", entry.tag)})
+					continue
+				}
+				group, known := exifTagGroups[entry.ifd][entry.tag]
+				if !known || !policy.Keeps(group) {
+					findings = append(findings, Finding{Kind: "exif", Detail: fmt.Sprintf("tag 0x%04X", entry.tag)})
+				}
+			}
+		}
+	}
+
+	// Decoders may find what the EXIF parser skipped
+	if report.GPS != nil && !containsKind(findings, "gps") {
+		findings = append(findings, Finding{Kind: "gps"})
+	}
+	if camera := report.Camera; camera != nil && (camera.Serial != "" || camera.LensSerial != "" || camera.OwnerName != "") {
+		findings = append(findings, Finding{Kind: "exif", Detail: "serial number or owner"})
+	}
+
+	if report.XMP {
+		findings = append(findings, Finding{Kind: "xmp"})
+	}
+	if report.IPTC {
+		findings = append(findings, Finding{Kind: "iptc"})
+	}
+	if report.ICCProfile && !policy.Keeps(GroupICCProfile) {
+		findings = append(findings, Finding{Kind: "icc-profile"})
+	}
+	if report.Thumbnails > 0 {
+		findings = append(findings, Finding{Kind: "thumbnail", Detail: fmt.Sprint(report.Thumbnails)})
+	}
+	for _, other := range report.Other {
+		findings = append(findings, Finding{Kind: "other", Detail: other})
+	}
+	return findings
+}
+
+// structuralVideoTags are container tags that describe the file format
+// rather than the recording.
+var structuralVideoTags = map[string]bool{
+	"major_brand":       true,
+	"minor_version":     true,
+	"compatible_brands": true,
+}
+
+// structuralStreamTags are stream tags that describe the stream rather than
+// the recording.
+var structuralStreamTags = map[string]bool{
+	"language":  true,
+	"vendor_id": true,
+	"rotate":    true,
+}
+
+// genericHandlerNames are the handler names FFmpeg writes.
+var genericHandlerNames = map[string]bool{
+	"":             true,
+	"VideoHandler": true,
+	"SoundHandler": true,
+}
+
+// videoFindings lists the metadata in a video that the policy does not keep.
+func videoFindings(report *VideoReport, policy Policy) []Finding {
+	var findings []Finding
+
+	for key := range report.Tags {
+		if structuralVideoTags[key] {
+			continue
+		}
+		group, known := videoTagGroups[strings.ToLower(key)]
+		if !known || !policy.Keeps(group) {
+			findings = append(findings, Finding{Kind: "container-tag", Detail: key})
+		}
+	}
+
+	for _, s := range report.Streams {
+		for key, value := range s.Tags {
+			if structuralStreamTags[key] || (key == "handler_name" && genericHandlerNames[value]) {
+				continue
+			}
+			if group, known := videoTagGroups[strings.ToLower(key)]; known && policy.Keeps(group) {
+				continue
+			}
+			findings = append(findings, Finding{Kind: "stream-tag", Detail: fmt.Sprintf("%s on stream %d", key, s.Index)})
+		}
+	}
+
+	for _, s := range report.DataTracks {
+		codec := s.CodecTag
+		if codec == "" || codec == "[0][0][0][0]" {
+			codec = s.Codec
+		}
+		findings = append(findings, Finding{Kind: "data-track", Detail: fmt.Sprintf("%d (%s %s)", s.Index, s.Type, codec)})
+	}
+
+	if report.Chapters > 0 {
+		findings = append(findings, Finding{Kind: "chapters", Detail: fmt.Sprint(report.Chapters)})
+	}
+
+	sortFindings(findings)
+	return findings
+}
+
+func containsKind(findings []Finding, kind string) bool {
+	for _, f := range findings {
+		if f.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// sortFindings orders findings gathered from maps so reports are stable.
+func sortFindings(findings []Finding) {
+	sort.Slice(findings, func(i, j int) bool {
+		if findings[i].Kind != findings[j].Kind {
+			return findings[i].Kind < findings[j].Kind
+		}
+		return findings[i].Detail < findings[j].Detail
+	})
+}